@@ -7,4 +7,7 @@ ISUCON_DB_NAME="isuride"
 
 # マッチング間隔（秒）
 ISUCON_MATCHING_INTERVAL=0.02
+
+# 椅子の位置を共有するほかの API ノード(カンマ区切り、例: http://192.168.0.12:8080)。API を受けるのがこのサーバーだけなら空
+ISUCON_CHAIR_LOCATION_PEERS=""
 PPROTEIN_GIT_REPOSITORY=/home/isucon
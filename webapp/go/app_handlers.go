@@ -1,11 +1,15 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -168,6 +172,8 @@ func (h *apiHandler) appPostPaymentMethods(w http.ResponseWriter, r *http.Reques
 
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
+	// 次のページを取るときに cursor に渡す。最後のページなら省く
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type getAppRidesResponseItem struct {
@@ -177,6 +183,7 @@ type getAppRidesResponseItem struct {
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
 	Evaluation            int                          `json:"evaluation"`
+	Status                string                       `json:"status"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
 }
@@ -188,94 +195,200 @@ type getAppRidesResponseItemChair struct {
 	Model string `json:"model"`
 }
 
+// ride_statuses.status に入りうる値
+var rideStatusValues = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "COMPLETED", "SCHEDULED", "CANCELED"}
+
+type rideWithStatus struct {
+	Ride
+	Status string `db:"status"`
+}
+
+// 既定のページの大きさ。limit か cursor を指定したときだけページに分ける
+const appGetRidesDefaultLimit = 50
+
+// ライドの履歴を要求日時の新しい順に返す。
+// status(カンマ区切り、既定は COMPLETED)と since/until(要求日時、unix ms)で絞り込み、
+// limit 件ずつ前のページの最後のライドIDを cursor に渡してたどる。
+// どちらも指定しなければこれまでどおり全件を返す
 func (h *apiHandler) appGetRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	tx, err := BeginMultiTx(h.db, h.db2)
+	cursor := r.URL.Query().Get("cursor")
+	limit := 0
+	if cursor != "" {
+		limit = appGetRidesDefaultLimit
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 100"))
+			return
+		}
+		limit = parsed
+	}
+	statuses := []string{"COMPLETED"}
+	if v := r.URL.Query().Get("status"); v != "" {
+		statuses = strings.Split(v, ",")
+		for _, status := range statuses {
+			if !slices.Contains(rideStatusValues, status) {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("unknown status: %s", status))
+				return
+			}
+		}
+	}
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 最新の状態はキャッシュを使わず、rides を要求日時の新しい順にたどってページの分で打ち切る
+	query := `
+		SELECT rides.*, rs.status
+		FROM rides
+		JOIN ride_statuses rs ON rs.id = (
+			SELECT id FROM ride_statuses WHERE ride_id = rides.id ORDER BY created_at DESC, id DESC LIMIT 1
+		)
+		WHERE rides.user_id = ?
+		  AND rides.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND`
+	args := []any{user.ID, since, until}
+	if cursor != "" {
+		var cursorCreatedAt time.Time
+		if err := h.db.GetContext(ctx, &cursorCreatedAt, "SELECT created_at FROM rides WHERE id = ? AND user_id = ?", cursor, user.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusBadRequest, errors.New("invalid cursor"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		query += `
+		  AND (rides.created_at, rides.id) < (?, ?)`
+		args = append(args, cursorCreatedAt, cursor)
+	}
+	query += `
+		  AND rs.status IN (?)
+		ORDER BY rides.created_at DESC, rides.id DESC`
+	args = append(args, statuses)
+	if limit > 0 {
+		query += `
+		LIMIT ?`
+		args = append(args, limit+1)
+	}
+	query, args, err = sqlx.In(query, args...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
 
-	rides := []Ride{}
-	if err := tx.SelectContext(
-		ctx, "db1",
-		&rides,
-		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC`,
-		user.ID,
-	); err != nil {
+	rides := []rideWithStatus{}
+	if err := h.db.SelectContext(ctx, &rides, query, args...); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	res := &getAppRidesResponse{Rides: []getAppRidesResponseItem{}}
+	if limit > 0 && len(rides) > limit {
+		rides = rides[:limit]
+		res.NextCursor = rides[len(rides)-1].ID
+	}
 
-	items := []getAppRidesResponseItem{}
-	for _, ride := range rides {
-		status, err := h.getLatestRideStatus(ctx, tx.tx1, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" {
-			continue
-		}
-
-		fare, err := calculateDiscountedFare(ctx, tx.tx2, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
+	chairs, owners, err := h.getChairsWithOwners(ctx, rides)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
+	for _, ride := range rides {
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
-			Evaluation:            *ride.Evaluation,
+			Fare:                  ride.Fare,
+			Status:                ride.Status,
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
 		}
+		if ride.Evaluation != nil {
+			item.Evaluation = *ride.Evaluation
+		}
+		if ride.Status == "COMPLETED" {
+			item.CompletedAt = ride.UpdatedAt.UnixMilli()
+		}
+		if chair, ok := chairs[ride.ChairID.String]; ok {
+			item.Chair = getAppRidesResponseItemChair{
+				ID:    chair.ID,
+				Owner: owners[chair.OwnerID].Name,
+				Name:  chair.Name,
+				Model: chair.Model,
+			}
+		}
+		res.Rides = append(res.Rides, item)
+	}
 
-		item.Chair = getAppRidesResponseItemChair{}
+	writeJSON(w, http.StatusOK, res)
+}
 
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, "db1", chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+// ライドに割り当てられた椅子とそのオーナーをまとめて引く
+func (h *apiHandler) getChairsWithOwners(ctx context.Context, rides []rideWithStatus) (map[string]Chair, map[string]Owner, error) {
+	chairIDs := []string{}
+	for _, ride := range rides {
+		if ride.ChairID.Valid && !slices.Contains(chairIDs, ride.ChairID.String) {
+			chairIDs = append(chairIDs, ride.ChairID.String)
 		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
+	}
+	chairs := map[string]Chair{}
+	owners := map[string]Owner{}
+	if len(chairIDs) == 0 {
+		return chairs, owners, nil
+	}
 
-		owner := &Owner{}
-		if err := tx.GetContext(ctx, "db2", owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	query, args, err := sqlx.In("SELECT * FROM chairs WHERE id IN (?)", chairIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	chairList := []Chair{}
+	if err := h.db.SelectContext(ctx, &chairList, query, args...); err != nil {
+		return nil, nil, err
+	}
+	ownerIDs := []string{}
+	for _, chair := range chairList {
+		chairs[chair.ID] = chair
+		if !slices.Contains(ownerIDs, chair.OwnerID) {
+			ownerIDs = append(ownerIDs, chair.OwnerID)
 		}
-		item.Chair.Owner = owner.Name
-
-		items = append(items, item)
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	query, args, err = sqlx.In("SELECT * FROM owners WHERE id IN (?)", ownerIDs)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
-	})
+	ownerList := []Owner{}
+	if err := h.db2.SelectContext(ctx, &ownerList, query, args...); err != nil {
+		return nil, nil, err
+	}
+	for _, owner := range ownerList {
+		owners[owner.ID] = owner
+	}
+	return chairs, owners, nil
 }
 
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	QuoteID               *string     `json:"quote_id"`
+	// 乗車地と目的地の間に順に立ち寄る地点
+	Waypoints []Coordinate `json:"waypoints"`
+	// 相乗りを選ぶと割引される。立ち寄り地点とは併用できない
+	Pooled bool `json:"pooled"`
+	// 予約する乗車日時(UNIXミリ秒)。無ければすぐに配車する
+	ScheduledAt *int64 `json:"scheduled_at"`
 }
 
 type appPostRidesResponse struct {
-	RideID string `json:"ride_id"`
-	Fare   int    `json:"fare"`
+	RideID          string  `json:"ride_id"`
+	Fare            int     `json:"fare"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	PoolDiscount    int     `json:"pool_discount,omitempty"`
+	ScheduledAt     *int64  `json:"scheduled_at,omitempty"`
 }
 
 type executableGet interface {
@@ -294,10 +407,43 @@ func (h *apiHandler) appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := h.serviceArea.validateTrip(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pooled && len(req.Waypoints) > 0 {
+		writeError(w, http.StatusBadRequest, errPooledRideWithWaypoints)
+		return
+	}
+
+	var scheduledAt sql.NullTime
+	if req.ScheduledAt != nil {
+		at := time.UnixMilli(*req.ScheduledAt)
+		if err := h.scheduledRides.validate(at, time.Now()); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		scheduledAt = sql.NullTime{Time: at, Valid: true}
+	}
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
 
+	// 見積もりの quote_id があれば、その時点の運賃で確定させる
+	var quote *fareQuote
+	if req.QuoteID != nil && *req.QuoteID != "" {
+		q, err := h.quoteSigner.verify(*req.QuoteID, time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !q.matches(user.ID, *req.PickupCoordinate, *req.DestinationCoordinate, req.Waypoints, req.Pooled) {
+			writeError(w, http.StatusBadRequest, errors.New("quote_id does not match this request"))
+			return
+		}
+		quote = q
+	}
+
 	tx, err := BeginMultiTx(h.db, h.db2)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -311,47 +457,82 @@ func (h *apiHandler) appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 予約中のライドは乗車中のライドと重ならないので、予約の有無にかかわらずすぐの配車はできる
 	continuingRideCount := 0
+	upcomingRideCount := 0
 	for _, ride := range rides {
 		status, err := h.getLatestRideStatus(ctx, tx.tx1, ride.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" {
+		switch status {
+		case "COMPLETED", "CANCELED":
+		case "SCHEDULED":
+			upcomingRideCount++
+		default:
 			continuingRideCount++
 		}
 	}
 
-	if continuingRideCount > 0 {
+	if scheduledAt.Valid {
+		if upcomingRideCount >= maxUpcomingScheduledRides {
+			writeError(w, http.StatusConflict, errors.New("too many scheduled rides"))
+			return
+		}
+	} else if continuingRideCount > 0 {
 		writeError(w, http.StatusConflict, errors.New("ride already exists"))
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx, "db1",
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	afterCommit, err := h.createRideStatus(ctx, tx.tx1, rideID, "MATCHING")
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 見積もり時と同じくライド作成時点の需給でサージ倍率を確定させ、以降はこの倍率で請求する。
+	// 予約の場合は乗車時の需給がわからないので、見積もりが無ければサージはかけない
+	surgeRate := noSurgeRate
+	if quote != nil {
+		surgeRate = quote.SurgeRate
+	} else if !scheduledAt.Valid {
+		surgeRate, err = h.calculateSurgeRate(ctx, tx.tx1, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 	}
 
 	var rideCount int
-	if err := tx.GetContext(ctx, "db1", &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
+	if err := tx.GetContext(
+		ctx, "db1", &rideCount,
+		`SELECT COUNT(*) FROM rides
+		 WHERE user_id = ?
+		   AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'CANCELED')`,
+		user.ID,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	var coupon Coupon
-	if rideCount == 1 {
+	if quote != nil {
+		// 見積もりに含めたクーポンだけを使う。その後に使われてしまっていたら見積もりの金額は守れない
+		if quote.CouponCode != "" {
+			result, err := tx.ExecContext(
+				ctx, "db2",
+				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ? AND used_by IS NULL",
+				rideID, user.ID, quote.CouponCode,
+			)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if count, err := result.RowsAffected(); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			} else if count == 0 {
+				writeError(w, http.StatusConflict, errors.New("coupon in the quote is no longer available"))
+				return
+			}
+			coupon.Code = quote.CouponCode
+		}
+	} else if rideCount == 0 {
 		// 初回利用で、初回利用クーポンがあれば必ず使う
 		if err := tx.GetContext(ctx, "db2", &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
@@ -404,13 +585,41 @@ func (h *apiHandler) appPostRides(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ride := Ride{}
-	if err := tx.GetContext(ctx, "db1", &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+	// 椅子はまだ割り当てられていないので、ひとまずデフォルトのレートで計算して保存する。
+	// サージ倍率とクーポンはここで確定させ、見積もりの quote_id があればその運賃で確定させる。
+	// 立ち寄り地点があっても1つのライドなので、初乗り運賃は1回だけで距離ぶんを区間ごとに足し合わせる
+	distance := routeDistance(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate)
+	price := defaultFareRate.price(distance, surgeRate, h.pool.discountPercent(req.Pooled), coupon.Discount)
+	if quote != nil {
+		price.Fare = quote.Fare
+		price.Discount = quote.Discount
+		price.PoolDiscount = quote.PoolDiscount
+	}
+	var couponCode *string
+	if coupon.Code != "" {
+		couponCode = &coupon.Code
+	}
+
+	if _, err := tx.ExecContext(
+		ctx, "db1",
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, surge_rate, fare, discount, coupon_code, scheduled_at, dormant, pooled, pool_discount, initial_fare, fare_per_distance, price_locked)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, surgeRate, price.Fare, price.Discount, couponCode, scheduledAt, scheduledAt.Valid, req.Pooled, price.PoolDiscount, price.Rate.InitialFare, price.Rate.FarePerDistance, quote != nil,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertRideWaypoints(ctx, tx.tx1, rideID, req.Waypoints); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx.tx2, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	// 予約は乗車日時の少し前まで配車待ちに入れない
+	initialStatus := "MATCHING"
+	if scheduledAt.Valid {
+		initialStatus = "SCHEDULED"
+	}
+	afterCommit, err := h.createRideStatus(ctx, tx.tx1, rideID, initialStatus)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -425,20 +634,32 @@ func (h *apiHandler) appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
-		RideID: rideID,
-		Fare:   fare,
-	})
+	res := &appPostRidesResponse{
+		RideID:          rideID,
+		Fare:            price.Fare,
+		SurgeMultiplier: surgeMultiplier(surgeRate),
+		PoolDiscount:    price.PoolDiscount,
+	}
+	if scheduledAt.Valid {
+		res.ScheduledAt = req.ScheduledAt
+	}
+	writeJSON(w, http.StatusAccepted, res)
 }
 
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	Pooled                bool         `json:"pooled"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
-	Fare     int `json:"fare"`
-	Discount int `json:"discount"`
+	Fare            int     `json:"fare"`
+	Discount        int     `json:"discount"`
+	PoolDiscount    int     `json:"pool_discount,omitempty"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	QuoteID         string  `json:"quote_id"`
+	QuoteExpiresAt  int64   `json:"quote_expires_at"`
 }
 
 func (h *apiHandler) appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -452,9 +673,23 @@ func (h *apiHandler) appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Re
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := h.serviceArea.validateTrip(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pooled && len(req.Waypoints) > 0 {
+		writeError(w, http.StatusBadRequest, errPooledRideWithWaypoints)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 
+	surgeRate, err := h.calculateSurgeRate(ctx, h.db, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	tx, err := h.db2.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -462,7 +697,7 @@ func (h *apiHandler) appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Re
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	coupon, err := findUnusedCoupon(ctx, tx, user.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -473,9 +708,42 @@ func (h *apiHandler) appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	discount := 0
+	couponCode := ""
+	if coupon != nil {
+		discount = coupon.Discount
+		couponCode = coupon.Code
+	}
+	// 椅子が決まるまでレートはわからないので、デフォルトのレートで見積もる
+	distance := routeDistance(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate)
+	price := defaultFareRate.price(distance, surgeRate, h.pool.discountPercent(req.Pooled), discount)
+
+	expiresAt := time.Now().Add(quoteTTL)
+	quoteID, err := h.quoteSigner.sign(&fareQuote{
+		UserID:       user.ID,
+		Pickup:       *req.PickupCoordinate,
+		Destination:  *req.DestinationCoordinate,
+		Waypoints:    req.Waypoints,
+		Fare:         price.Fare,
+		Discount:     price.Discount,
+		Pooled:       req.Pooled,
+		PoolDiscount: price.PoolDiscount,
+		SurgeRate:    surgeRate,
+		CouponCode:   couponCode,
+		ExpiresAt:    expiresAt.UnixMilli(),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Fare:            price.Fare,
+		Discount:        price.Discount,
+		PoolDiscount:    price.PoolDiscount,
+		SurgeMultiplier: surgeMultiplier(surgeRate),
+		QuoteID:         quoteID,
+		QuoteExpiresAt:  expiresAt.UnixMilli(),
 	})
 }
 
@@ -580,17 +848,13 @@ func (h *apiHandler) appPostRideEvaluatation(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx.tx2, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
+		Amount: ride.Fare,
 	}
 
 	var ridesCount int
-	if err := tx.tx1.QueryRowContext(ctx, `SELECT COUNT(*) FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID).Scan(&ridesCount); err != nil {
+	// 予約中・キャンセル済みのライドは決済されないので数えない
+	if err := tx.tx1.QueryRowContext(ctx, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND dormant = FALSE ORDER BY created_at ASC`, ride.UserID).Scan(&ridesCount); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 	}
 	if err := h.requestPaymentGatewayPostPayment(ctx, paymentToken.Token, paymentGatewayRequest, ridesCount); err != nil {
@@ -610,6 +874,13 @@ func (h *apiHandler) appPostRideEvaluatation(w http.ResponseWriter, r *http.Requ
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// 相乗りの相手がまだ乗っていれば椅子は空かない
+	if partnerActive, err := h.poolPartnerActive(ctx, h.db, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !partnerActive {
+		h.chairGrid.setBusy(ride.ChairID.String, false)
+	}
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
 		CompletedAt: ride.UpdatedAt.UnixMilli(),
@@ -630,6 +901,18 @@ type appGetNotificationResponseData struct {
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
+	// ENROUTE の間は乗車地まで、CARRYING の間は立ち寄り地点を回って目的地までの見込み時間
+	PickupETAMs  *int64                 `json:"pickup_eta_ms,omitempty"`
+	DropoffETAMs *int64                 `json:"dropoff_eta_ms,omitempty"`
+	Waypoints    []rideWaypointResponse `json:"waypoints,omitempty"`
+	// 同じ椅子に相乗りしている相手がいるとき
+	SharedTrip *appGetNotificationResponseSharedTrip `json:"shared_trip,omitempty"`
+}
+
+// 相手の乗車地や目的地は返さず、状態だけを知らせる
+type appGetNotificationResponseSharedTrip struct {
+	PartnerStatus string `json:"partner_status"`
+	PoolDiscount  int    `json:"pool_discount"`
 }
 
 type appGetNotificationResponseChair struct {
@@ -656,7 +939,8 @@ func (h *apiHandler) appGetNotification(w http.ResponseWriter, r *http.Request)
 	defer tx.Rollback()
 
 	ride := &Ride{}
-	if err := tx.tx1.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+	// 予約していたライドは配車待ちに入った時点で updated_at が進むので、作成日時ではなく更新日時で最新のものを選ぶ
+	if err := tx.tx1.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? AND dormant = FALSE ORDER BY updated_at DESC LIMIT 1`, user.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
 				RetryAfterMs: 100,
@@ -684,7 +968,7 @@ func (h *apiHandler) appGetNotification(w http.ResponseWriter, r *http.Request)
 		status = yetSentRideStatus.Status
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx.tx2, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	waypoints, err := getRideWaypoints(ctx, tx.tx1, ride.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -701,14 +985,27 @@ func (h *apiHandler) appGetNotification(w http.ResponseWriter, r *http.Request)
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Fare:      fare,
+			Fare:      ride.Fare,
 			Status:    status,
 			CreatedAt: ride.CreatedAt.UnixMilli(),
 			UpdateAt:  ride.UpdatedAt.UnixMilli(),
+			Waypoints: newRideWaypointsResponse(waypoints),
 		},
 		RetryAfterMs: 100,
 	}
 
+	if ride.PooledWith.Valid {
+		partnerStatus, err := h.getLatestRideStatus(ctx, tx.tx1, ride.PooledWith.String)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		response.Data.SharedTrip = &appGetNotificationResponseSharedTrip{
+			PartnerStatus: partnerStatus,
+			PoolDiscount:  ride.PoolDiscount,
+		}
+	}
+
 	if ride.ChairID.Valid {
 		chair := &Chair{}
 		if err := tx.tx1.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
@@ -728,6 +1025,15 @@ func (h *apiHandler) appGetNotification(w http.ResponseWriter, r *http.Request)
 			Model: chair.Model,
 			Stats: stats,
 		}
+
+		if location, ok := h.chairLocations.get(chair.ID); ok && (status == "ENROUTE" || status == "CARRYING") {
+			current := Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}
+			if status == "ENROUTE" {
+				response.Data.PickupETAMs = h.estimateArrivalMs(chair.Model, current, response.Data.PickupCoordinate)
+			} else {
+				response.Data.DropoffETAMs = h.estimateTravelMs(chair.Model, remainingRoute(current, waypoints, response.Data.DestinationCoordinate))
+			}
+		}
 	}
 
 	afterCommit := afterCommitNop
@@ -850,10 +1156,13 @@ type appGetNearbyChairsResponseChair struct {
 	Name              string     `json:"name"`
 	Model             string     `json:"model"`
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
+	// 指定した座標に着くまでの見込み時間
+	ETAMs *int64 `json:"eta_ms"`
+	// 乗車中で、相乗りなら乗せられる
+	Shared bool `json:"shared,omitempty"`
 }
 
 func (h *apiHandler) appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
 	latStr := r.URL.Query().Get("latitude")
 	lonStr := r.URL.Query().Get("longitude")
 	distanceStr := r.URL.Query().Get("distance")
@@ -885,80 +1194,23 @@ func (h *apiHandler) appGetNearbyChairs(w http.ResponseWriter, r *http.Request)
 
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
-	tx, err := BeginMultiTx(h.db, h.db2)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	chairs := []Chair{}
-	err = tx.tx1.SelectContext(
-		ctx,
-		&chairs,
-		`SELECT * FROM chairs`,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
+	// pooled=true なら相乗りを受け付けている椅子も返す
+	includePool := r.URL.Query().Get("pooled") == "true"
+	chairs := h.chairGrid.nearby(coordinate, distance, includePool)
+	slices.SortFunc(chairs, func(a, b chairGridState) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
 
-	nearbyChairs := []appGetNearbyChairsResponseChair{}
+	nearbyChairs := make([]appGetNearbyChairsResponseChair, 0, len(chairs))
 	for _, chair := range chairs {
-		if !chair.IsActive {
-			continue
-		}
-
-		rides := []*Ride{}
-		if err := tx.tx1.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id = ? ORDER BY created_at DESC`, chair.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		skip := false
-		for _, ride := range rides {
-			// 過去にライドが存在し、かつ、それが完了していない場合はスキップ
-			status, err := h.getLatestRideStatus(ctx, tx.tx1, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-			if status != "COMPLETED" {
-				skip = true
-				break
-			}
-		}
-		if skip {
-			continue
-		}
-
-		// 最新の位置情報を取得
-		chairLocation := &ChairLocation{}
-		err = tx.tx1.GetContext(
-			ctx,
-			chairLocation,
-			`SELECT * FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1`,
-			chair.ID,
-		)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				continue
-			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		if calculateDistance(coordinate.Latitude, coordinate.Longitude, chairLocation.Latitude, chairLocation.Longitude) <= distance {
-			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Model: chair.Model,
-				CurrentCoordinate: Coordinate{
-					Latitude:  chairLocation.Latitude,
-					Longitude: chairLocation.Longitude,
-				},
-			})
-		}
+		nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
+			ID:                chair.ID,
+			Name:              chair.Name,
+			Model:             chair.Model,
+			CurrentCoordinate: *chair.Location,
+			ETAMs:             h.estimateArrivalMs(chair.Model, *chair.Location, coordinate),
+			Shared:            !chair.free(),
+		})
 	}
 
 	retrievedAt := time.Now()
@@ -969,50 +1221,24 @@ func (h *apiHandler) appGetNearbyChairs(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
-}
-
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
+// 次のライドで使われる予定のクーポンを返す。無ければ nil
+func findUnusedCoupon(ctx context.Context, tx *sqlx.Tx, userID string) (*Coupon, error) {
+	coupon := &Coupon{}
+	// 初回利用クーポンを最優先で使う
+	if err := tx.GetContext(ctx, coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
 		}
 	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
+		return coupon, nil
+	}
 
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
+	// 無いなら他のクーポンを付与された順番に使う
+	if err := tx.GetContext(ctx, coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
 		}
+		return nil, nil
 	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
+	return coupon, nil
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 1リクエストで受け付ける位置の最大数
+const maxBatchCoordinates = 1000
+
+var errStaleCoordinate = errors.New("coordinates must be newer than the last recorded coordinate")
+
+type chairCoordinate struct {
+	Coordinate
+	// ゼロ値ならサーバーが受け取った時刻にする
+	RecordedAt time.Time
+}
+
+// 椅子の位置をまとめて記録し、総移動距離の更新とライドの PICKUP/ARRIVED の判定を行う。
+// coordinates は古い順に並んでいること。記録した位置を古い順に返す
+func (h *apiHandler) recordChairCoordinates(ctx context.Context, chair *Chair, coordinates []chairCoordinate) ([]ChairLocation, error) {
+	// 位置は db1 にしか無いので db2 のトランザクションは開かない
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 同じ椅子の位置更新を直列にして、直前の位置を確実に読む
+	var locked string
+	if err := tx.GetContext(ctx, &locked, "SELECT id FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		return nil, err
+	}
+	var latest *ChairLocation
+	latestLocation := &ChairLocation{}
+	if err := tx.GetContext(ctx, latestLocation, "SELECT * FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1", chair.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	} else {
+		latest = latestLocation
+	}
+
+	prev := latest
+
+	locations := make([]ChairLocation, 0, len(coordinates))
+	for _, coordinate := range coordinates {
+		recordedAt := coordinate.RecordedAt
+		if recordedAt.IsZero() {
+			recordedAt = time.Now()
+			// DB とアプリの時計がずれていても順序が入れ替わらないようにする
+			if prev != nil && !recordedAt.After(prev.CreatedAt) {
+				recordedAt = prev.CreatedAt.Add(time.Microsecond)
+			}
+		}
+		recordedAt = recordedAt.Truncate(time.Microsecond)
+		if prev != nil && !recordedAt.After(prev.CreatedAt) {
+			return nil, errStaleCoordinate
+		}
+		location := ChairLocation{
+			ID:        ulid.Make().String(),
+			ChairID:   chair.ID,
+			Latitude:  coordinate.Latitude,
+			Longitude: coordinate.Longitude,
+			CreatedAt: recordedAt,
+		}
+		locations = append(locations, location)
+		prev = &locations[len(locations)-1]
+	}
+
+	if _, err := tx.NamedExecContext(
+		ctx,
+		`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (:id, :chair_id, :latitude, :longitude, :created_at)`,
+		locations,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := addChairTotalDistance(ctx, tx, chair.ID, latest, locations); err != nil {
+		return nil, err
+	}
+
+	// 相乗り中は2つのライドをそれぞれ進める
+	afterCommits := []afterCommitFunc{}
+	var rideStatus *string
+	arrivedRideIDs := []string{}
+	rides, err := chairCurrentRides(ctx, tx, chair.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	for _, ride := range rides {
+		status, acs, err := h.advanceRideByLocations(ctx, tx, &ride, locations)
+		if err != nil {
+			return nil, err
+		}
+		afterCommits = append(afterCommits, acs...)
+		if status == "ARRIVED" {
+			arrivedRideIDs = append(arrivedRideIDs, ride.ID)
+		}
+		if rideStatus == nil && status != "COMPLETED" && status != "CANCELED" {
+			rideStatus = &status
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, ac := range afterCommits {
+		if err := ac(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	last := locations[len(locations)-1]
+	h.applyChairLocation(last)
+	h.chairLocations.publish(last)
+	for _, rideID := range arrivedRideIDs {
+		h.chairGrid.closePoolRide(chair.ID, rideID)
+	}
+	h.fleet.publish(fleetEvent{
+		OwnerID:    chair.OwnerID,
+		Chair:      *chair,
+		Coordinate: Coordinate{Latitude: last.Latitude, Longitude: last.Longitude},
+		RideStatus: rideStatus,
+		RecordedAt: last.CreatedAt,
+	})
+
+	return locations, nil
+}
+
+// 記録した位置からライドの PICKUP/ARRIVED を判定して状態を作り、判定後の状態を返す
+func (h *apiHandler) advanceRideByLocations(ctx context.Context, tx *sqlx.Tx, ride *Ride, locations []ChairLocation) (string, []afterCommitFunc, error) {
+	latestStatus, err := h.getLatestRideStatusDetail(ctx, ride.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	status := latestStatus.Status
+	if status == "COMPLETED" || status == "CANCELED" {
+		return status, nil, nil
+	}
+	waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	afterCommits := []afterCommitFunc{}
+	// 今の状態になる前の位置では判定しない。状態はその位置を記録した時刻で作る
+	statusAt := latestStatus.CreatedAt
+	for _, location := range locations {
+		if location.CreatedAt.Before(statusAt) {
+			continue
+		}
+		// 乗車中は立ち寄り地点を順に回り、全部回ってから目的地に着いたら ARRIVED にする
+		if status == "CARRYING" {
+			if arrived, err := arriveRideWaypoint(ctx, tx, waypoints, location); err != nil {
+				return "", nil, err
+			} else if arrived != nil {
+				continue
+			}
+		}
+		next := ""
+		if location.Latitude == ride.PickupLatitude && location.Longitude == ride.PickupLongitude && status == "ENROUTE" {
+			next = "PICKUP"
+		}
+		if location.Latitude == ride.DestinationLatitude && location.Longitude == ride.DestinationLongitude && status == "CARRYING" && nextRideWaypoint(waypoints) == nil {
+			next = "ARRIVED"
+		}
+		if next == "" {
+			continue
+		}
+		ac, err := h.createRideStatusAt(ctx, tx, ride.ID, next, location.CreatedAt)
+		if err != nil {
+			return "", nil, err
+		}
+		afterCommits = append(afterCommits, ac)
+		status = next
+		statusAt = location.CreatedAt
+	}
+	return status, afterCommits, nil
+}
+
+type chairPostCoordinatesRequest struct {
+	Coordinates []chairPostCoordinatesRequestCoordinate `json:"coordinates"`
+}
+
+type chairPostCoordinatesRequestCoordinate struct {
+	Latitude  int   `json:"latitude"`
+	Longitude int   `json:"longitude"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type chairPostCoordinatesResponse struct {
+	Recorded   int   `json:"recorded"`
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+// 通信が不安定な間に溜めた位置をまとめて受け取る。timestamp は位置を取得した時刻(ミリ秒)
+func (h *apiHandler) chairPostCoordinates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &chairPostCoordinatesRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Coordinates) == 0 || len(req.Coordinates) > maxBatchCoordinates {
+		writeError(w, http.StatusBadRequest, errors.New("coordinates must contain between 1 and 1000 items"))
+		return
+	}
+
+	chair := ctx.Value("chair").(*Chair)
+
+	now := time.Now()
+	coordinates := make([]chairCoordinate, 0, len(req.Coordinates))
+	for _, c := range req.Coordinates {
+		recordedAt := time.UnixMilli(c.Timestamp)
+		if c.Timestamp <= 0 || recordedAt.After(now) {
+			writeError(w, http.StatusBadRequest, errors.New("timestamp must be a past unix time in milliseconds"))
+			return
+		}
+		coordinates = append(coordinates, chairCoordinate{
+			Coordinate: Coordinate{Latitude: c.Latitude, Longitude: c.Longitude},
+			RecordedAt: recordedAt,
+		})
+	}
+	slices.SortStableFunc(coordinates, func(a, b chairCoordinate) int {
+		return a.RecordedAt.Compare(b.RecordedAt)
+	})
+	for i := 1; i < len(coordinates); i++ {
+		if coordinates[i].RecordedAt.Equal(coordinates[i-1].RecordedAt) {
+			writeError(w, http.StatusBadRequest, errors.New("timestamps must be unique"))
+			return
+		}
+	}
+
+	locations, err := h.recordChairCoordinates(ctx, chair, coordinates)
+	if err != nil {
+		if errors.Is(err, errStaleCoordinate) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairPostCoordinatesResponse{
+		Recorded:   len(locations),
+		RecordedAt: locations[len(locations)-1].CreatedAt.UnixMilli(),
+	})
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 付近の椅子を探すグリッドの一辺の長さ。appGetNearbyChairs の既定の距離に合わせている
+const chairGridCellSize = 50
+
+type chairGridCell struct {
+	Latitude  int
+	Longitude int
+}
+
+type chairGridState struct {
+	ID     string
+	Name   string
+	Model  string
+	Active bool
+	Busy   bool
+	// 位置の送信が途絶えている。次に位置を受け取ったら戻す
+	Stale    bool
+	Location *Coordinate
+	// 相乗りを選んだ利用者を乗せていて、もう1人乗せられるときのそのライド
+	PoolRide *chairGridPoolRide
+}
+
+type chairGridPoolRide struct {
+	RideID      string
+	Destination Coordinate
+}
+
+func (s *chairGridState) available() bool {
+	return s.Active && !s.Stale && s.Location != nil
+}
+
+func (s *chairGridState) free() bool {
+	return s.available() && !s.Busy
+}
+
+func (s *chairGridState) poolOpen() bool {
+	return s.available() && s.PoolRide != nil
+}
+
+// 空いているか相乗りできる、位置のわかっている椅子だけをグリッドに入れる
+func (s *chairGridState) indexed() bool {
+	return s.free() || s.poolOpen()
+}
+
+// chairGrid は空いているアクティブな椅子を、位置が属するグリッドごとに持つ空間インデックス。
+// 椅子の状態が変わるたびに各ハンドラから更新する
+type chairGrid struct {
+	mu     sync.RWMutex
+	chairs map[string]*chairGridState
+	cells  map[chairGridCell]map[string]*chairGridState
+	// 最後に作り直した日時
+	loadedAt time.Time
+}
+
+func newChairGrid() *chairGrid {
+	return &chairGrid{
+		chairs: map[string]*chairGridState{},
+		cells:  map[chairGridCell]map[string]*chairGridState{},
+	}
+}
+
+func chairGridCellOf(c Coordinate) chairGridCell {
+	return chairGridCell{
+		Latitude:  floorDiv(c.Latitude, chairGridCellSize),
+		Longitude: floorDiv(c.Longitude, chairGridCellSize),
+	}
+}
+
+// 今の状態を全部捨てて states で置き換える
+func (g *chairGrid) reset(states []*chairGridState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.chairs = make(map[string]*chairGridState, len(states))
+	g.cells = map[chairGridCell]map[string]*chairGridState{}
+	g.loadedAt = time.Now()
+	for _, state := range states {
+		g.chairs[state.ID] = state
+		g.index(state)
+	}
+}
+
+func (g *chairGrid) index(state *chairGridState) {
+	if !state.indexed() {
+		return
+	}
+	cell := chairGridCellOf(*state.Location)
+	if _, ok := g.cells[cell]; !ok {
+		g.cells[cell] = map[string]*chairGridState{}
+	}
+	g.cells[cell][state.ID] = state
+}
+
+func (g *chairGrid) unindex(state *chairGridState) {
+	if !state.indexed() {
+		return
+	}
+	cell := chairGridCellOf(*state.Location)
+	delete(g.cells[cell], state.ID)
+	if len(g.cells[cell]) == 0 {
+		delete(g.cells, cell)
+	}
+}
+
+// 椅子の状態を書き換えてグリッドに入れ直す。知らない椅子なら何もしない
+func (g *chairGrid) update(chairID string, fn func(state *chairGridState)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state, ok := g.chairs[chairID]
+	if !ok {
+		return
+	}
+	g.unindex(state)
+	fn(state)
+	g.index(state)
+}
+
+// 登録・名前の変更・稼働状態の変更を反映する。引退した椅子はグリッドから外す
+func (g *chairGrid) setChair(chair Chair) {
+	if chair.RetiredAt.Valid {
+		g.remove(chair.ID)
+		return
+	}
+	g.mu.Lock()
+	if _, ok := g.chairs[chair.ID]; !ok {
+		g.chairs[chair.ID] = &chairGridState{ID: chair.ID}
+	}
+	g.mu.Unlock()
+
+	g.update(chair.ID, func(state *chairGridState) {
+		state.Name = chair.Name
+		state.Model = chair.Model
+		state.Active = chair.IsActive
+	})
+}
+
+func (g *chairGrid) setActive(chairID string, active bool) {
+	g.update(chairID, func(state *chairGridState) {
+		state.Active = active
+	})
+}
+
+// ライドが割り当てられたら busy、完了したら空きに戻す
+func (g *chairGrid) setBusy(chairID string, busy bool) {
+	g.update(chairID, func(state *chairGridState) {
+		state.Busy = busy
+	})
+}
+
+func (g *chairGrid) setLocation(chairID string, location Coordinate) {
+	g.update(chairID, func(state *chairGridState) {
+		state.Location = &location
+		state.Stale = false
+	})
+}
+
+// 相乗りできるライドを乗せたら設定し、相手が決まるか降ろしたら nil に戻す
+func (g *chairGrid) setPoolRide(chairID string, poolRide *chairGridPoolRide) {
+	g.update(chairID, func(state *chairGridState) {
+		state.PoolRide = poolRide
+	})
+}
+
+// rideID のライドで相乗りを受け付けていれば締め切る
+func (g *chairGrid) closePoolRide(chairID string, rideID string) {
+	g.update(chairID, func(state *chairGridState) {
+		if state.PoolRide != nil && state.PoolRide.RideID == rideID {
+			state.PoolRide = nil
+		}
+	})
+}
+
+// 相乗りを受け付けている椅子。数は少ないので全部返す
+func (g *chairGrid) poolChairs() []chairGridState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	chairs := []chairGridState{}
+	for _, state := range g.chairs {
+		if state.poolOpen() {
+			chairs = append(chairs, *state)
+		}
+	}
+	return chairs
+}
+
+func (g *chairGrid) setStale(chairID string) {
+	g.update(chairID, func(state *chairGridState) {
+		state.Stale = true
+	})
+}
+
+func (g *chairGrid) isStale(chairID string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	state, ok := g.chairs[chairID]
+	return ok && state.Stale
+}
+
+func (g *chairGrid) lastLoadedAt() time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.loadedAt
+}
+
+// 稼働中で、位置を送ってきたことがあり、まだ途絶えていない椅子
+func (g *chairGrid) reportingChairIDs() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	ids := []string{}
+	for id, state := range g.chairs {
+		if state.Active && !state.Stale && state.Location != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (g *chairGrid) remove(chairID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if state, ok := g.chairs[chairID]; ok {
+		g.unindex(state)
+		delete(g.chairs, chairID)
+	}
+}
+
+// center からマンハッタン距離で distance 以内の空いている椅子を返す。includePool なら相乗りできる椅子も含める。
+// 範囲に重なるグリッドだけを見るので、椅子の総数には比例しない
+func (g *chairGrid) nearby(center Coordinate, distance int, includePool bool) []chairGridState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	chairs := []chairGridState{}
+	g.eachCell(
+		Coordinate{Latitude: center.Latitude - distance, Longitude: center.Longitude - distance},
+		Coordinate{Latitude: center.Latitude + distance, Longitude: center.Longitude + distance},
+		func(cell map[string]*chairGridState) {
+			for _, state := range cell {
+				if !state.free() && !includePool {
+					continue
+				}
+				if calculateDistance(center.Latitude, center.Longitude, state.Location.Latitude, state.Location.Longitude) <= distance {
+					chairs = append(chairs, *state)
+				}
+			}
+		},
+	)
+	return chairs
+}
+
+// lower から upper までの矩形(両端を含む)にいる空いている椅子の数。途絶えた椅子や乗車中の椅子は数えない
+func (g *chairGrid) countFree(lower, upper Coordinate) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	count := 0
+	g.eachCell(lower, upper, func(cell map[string]*chairGridState) {
+		for _, state := range cell {
+			if state.free() &&
+				state.Location.Latitude >= lower.Latitude && state.Location.Latitude <= upper.Latitude &&
+				state.Location.Longitude >= lower.Longitude && state.Location.Longitude <= upper.Longitude {
+				count++
+			}
+		}
+	})
+	return count
+}
+
+// lower から upper までの矩形に重なる空でないグリッドごとに fn を呼ぶ。呼び出し側でロックしておくこと
+func (g *chairGrid) eachCell(lower, upper Coordinate, fn func(cell map[string]*chairGridState)) {
+	minCell := chairGridCellOf(lower)
+	maxCell := chairGridCellOf(upper)
+
+	// 範囲がグリッドの数より広ければ、空でないグリッドを全部見る方が速い
+	height := maxCell.Latitude - minCell.Latitude + 1
+	width := maxCell.Longitude - minCell.Longitude + 1
+	if height > len(g.cells) || width > len(g.cells) || height*width > len(g.cells) {
+		for _, cell := range g.cells {
+			fn(cell)
+		}
+		return
+	}
+	for lat := minCell.Latitude; lat <= maxCell.Latitude; lat++ {
+		for lon := minCell.Longitude; lon <= maxCell.Longitude; lon++ {
+			if cell, ok := g.cells[chairGridCell{Latitude: lat, Longitude: lon}]; ok {
+				fn(cell)
+			}
+		}
+	}
+}
+
+// chairs と未完了のライドから椅子の状態を作り直す。位置は chairLocations から取るので、先に読み込んでおくこと
+func (h *apiHandler) initChairGrid(ctx context.Context) error {
+	chairs := []Chair{}
+	if err := h.db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE retired_at IS NULL"); err != nil {
+		return err
+	}
+	busyChairIDs := []string{}
+	if err := h.db.SelectContext(ctx, &busyChairIDs, `
+		SELECT DISTINCT chair_id FROM rides
+		WHERE chair_id IS NOT NULL
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'COMPLETED')
+	`); err != nil {
+		return err
+	}
+	busy := make(map[string]bool, len(busyChairIDs))
+	for _, id := range busyChairIDs {
+		busy[id] = true
+	}
+	poolRides, err := h.openPoolRides(ctx)
+	if err != nil {
+		return err
+	}
+
+	states := make([]*chairGridState, 0, len(chairs))
+	for _, chair := range chairs {
+		state := &chairGridState{
+			ID:     chair.ID,
+			Name:   chair.Name,
+			Model:  chair.Model,
+			Active: chair.IsActive,
+			Busy:   busy[chair.ID],
+		}
+		if ride, ok := poolRides[chair.ID]; ok {
+			state.PoolRide = &ride
+		}
+		if location, ok := h.chairLocations.get(chair.ID); ok {
+			state.Location = &Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}
+		}
+		states = append(states, state)
+	}
+	h.chairGrid.reset(states)
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// 椅子がグリッドのどのセルに入っているか。入っていなければ false
+func indexedCell(g *chairGrid, chairID string) (chairGridCell, bool) {
+	for cell, chairs := range g.cells {
+		if _, ok := chairs[chairID]; ok {
+			return cell, true
+		}
+	}
+	return chairGridCell{}, false
+}
+
+func newTestChairGrid(location Coordinate) *chairGrid {
+	g := newChairGrid()
+	g.reset([]*chairGridState{{ID: "chair", Active: true, Location: &location}})
+	return g
+}
+
+func assertIndexed(t *testing.T, g *chairGrid, want bool) {
+	t.Helper()
+	if _, ok := indexedCell(g, "chair"); ok != want {
+		t.Fatalf("indexed = %v, want %v", ok, want)
+	}
+	found := len(g.nearby(Coordinate{Latitude: 10, Longitude: 10}, 10, false)) > 0
+	if found != want {
+		t.Fatalf("nearby found = %v, want %v", found, want)
+	}
+}
+
+func TestChairGridSetBusy(t *testing.T) {
+	g := newTestChairGrid(Coordinate{Latitude: 10, Longitude: 10})
+	assertIndexed(t, g, true)
+
+	g.setBusy("chair", true)
+	assertIndexed(t, g, false)
+	if len(g.cells) != 0 {
+		t.Fatalf("empty cells should be removed, got %d cells", len(g.cells))
+	}
+
+	g.setBusy("chair", false)
+	assertIndexed(t, g, true)
+}
+
+func TestChairGridSetStale(t *testing.T) {
+	g := newTestChairGrid(Coordinate{Latitude: 10, Longitude: 10})
+
+	g.setStale("chair")
+	assertIndexed(t, g, false)
+	if !g.isStale("chair") {
+		t.Fatal("chair should be stale")
+	}
+
+	// 位置が届けば途絶えていた椅子も戻る
+	g.setLocation("chair", Coordinate{Latitude: 10, Longitude: 10})
+	assertIndexed(t, g, true)
+	if g.isStale("chair") {
+		t.Fatal("chair should not be stale after reporting a location")
+	}
+}
+
+func TestChairGridSetActive(t *testing.T) {
+	g := newTestChairGrid(Coordinate{Latitude: 10, Longitude: 10})
+
+	g.setActive("chair", false)
+	assertIndexed(t, g, false)
+
+	g.setActive("chair", true)
+	assertIndexed(t, g, true)
+}
+
+func TestChairGridSetLocation(t *testing.T) {
+	tests := []struct {
+		name string
+		from Coordinate
+		to   Coordinate
+	}{
+		{name: "同じセルの中", from: Coordinate{Latitude: 1, Longitude: 1}, to: Coordinate{Latitude: 2, Longitude: 3}},
+		{name: "隣のセルへ", from: Coordinate{Latitude: 49, Longitude: 10}, to: Coordinate{Latitude: 50, Longitude: 10}},
+		{name: "離れたセルへ", from: Coordinate{Latitude: 10, Longitude: 10}, to: Coordinate{Latitude: 320, Longitude: -140}},
+		{name: "負の座標のセルへ", from: Coordinate{Latitude: 0, Longitude: 0}, to: Coordinate{Latitude: -1, Longitude: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestChairGrid(tt.from)
+			g.setLocation("chair", tt.to)
+
+			cell, ok := indexedCell(g, "chair")
+			if !ok {
+				t.Fatal("chair should be indexed")
+			}
+			if want := chairGridCellOf(tt.to); cell != want {
+				t.Fatalf("cell = %+v, want %+v", cell, want)
+			}
+			if len(g.cells) != 1 {
+				t.Fatalf("old cell should be removed, got %d cells", len(g.cells))
+			}
+			if chairs := g.nearby(tt.to, 0, false); len(chairs) != 1 {
+				t.Fatalf("nearby(to) = %d chairs, want 1", len(chairs))
+			}
+			if tt.from != tt.to && len(g.nearby(tt.from, 0, false)) != 0 {
+				t.Fatal("chair should not be found at its old location")
+			}
+		})
+	}
+}
+
+func TestChairGridSetLocationWhileBusy(t *testing.T) {
+	g := newTestChairGrid(Coordinate{Latitude: 10, Longitude: 10})
+	g.setBusy("chair", true)
+
+	// 乗車中に別のセルへ移動してから空けば、移動先のセルに入る
+	g.setLocation("chair", Coordinate{Latitude: 200, Longitude: 200})
+	if _, ok := indexedCell(g, "chair"); ok {
+		t.Fatal("busy chair should not be indexed")
+	}
+	g.setBusy("chair", false)
+	cell, ok := indexedCell(g, "chair")
+	if !ok || cell != chairGridCellOf(Coordinate{Latitude: 200, Longitude: 200}) {
+		t.Fatalf("cell = %+v (indexed %v), want the cell of the new location", cell, ok)
+	}
+}
+
+func TestChairGridCountFree(t *testing.T) {
+	g := newChairGrid()
+	location := func(lat, lon int) *Coordinate { return &Coordinate{Latitude: lat, Longitude: lon} }
+	g.reset([]*chairGridState{
+		{ID: "free", Active: true, Location: location(5, 5)},
+		{ID: "edge", Active: true, Location: location(19, 19)},
+		{ID: "outside", Active: true, Location: location(20, 5)},
+		{ID: "busy", Active: true, Busy: true, Location: location(5, 5)},
+		{ID: "stale", Active: true, Stale: true, Location: location(5, 5)},
+		{ID: "inactive", Active: false, Location: location(5, 5)},
+		{ID: "pool", Active: true, Busy: true, PoolRide: &chairGridPoolRide{RideID: "ride"}, Location: location(5, 5)},
+	})
+
+	if got := g.countFree(Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 19, Longitude: 19}); got != 2 {
+		t.Fatalf("countFree() = %d, want 2", got)
+	}
+}
+
+// 椅子の密度を一定にして台数だけを増やす。検索範囲に入る椅子の数は変わらないので、
+// グリッドが効いていれば台数によらずほぼ同じ時間になる
+func BenchmarkChairGridNearby(b *testing.B) {
+	const distance = 50
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("chairs=%d", n), func(b *testing.B) {
+			rng := rand.New(rand.NewPCG(1, 2))
+			side := int(math.Sqrt(float64(n))) * 10
+			states := make([]*chairGridState, 0, n)
+			for i := range n {
+				states = append(states, &chairGridState{
+					ID:       fmt.Sprintf("chair-%d", i),
+					Active:   true,
+					Location: &Coordinate{Latitude: rng.IntN(side), Longitude: rng.IntN(side)},
+				})
+			}
+			g := newChairGrid()
+			g.reset(states)
+
+			// 端に近いと範囲に入る椅子が減るので、検索の中心は端から distance 以上離す
+			centers := make([]Coordinate, 1024)
+			for i := range centers {
+				centers[i] = Coordinate{Latitude: distance + rng.IntN(side-2*distance), Longitude: distance + rng.IntN(side-2*distance)}
+			}
+
+			found := 0
+			b.ResetTimer()
+			for i := range b.N {
+				found += len(g.nearby(centers[i%len(centers)], distance, false))
+			}
+			b.ReportMetric(float64(found)/float64(b.N), "chairs/op")
+		})
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 )
@@ -33,21 +33,58 @@ func (h *apiHandler) chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := BeginMultiTx(h.db, h.db2)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
 	owner := &Owner{}
-	if err := h.db2.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
+	if err := tx.GetContext(ctx, "db2", owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// オーナーが追加で発行した制限付きのトークンかどうか
+		registerToken := &ChairRegisterToken{}
+		if err := tx.GetContext(ctx, "db2", registerToken, "SELECT * FROM chair_register_tokens WHERE token = ? FOR UPDATE", req.ChairRegisterToken); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if registerToken.ExpiresAt.Valid && time.Now().After(registerToken.ExpiresAt.Time) {
+			writeError(w, http.StatusUnauthorized, errors.New("chair_register_token has expired"))
+			return
+		}
+		if registerToken.MaxChairs != nil && registerToken.RegisteredChairs >= *registerToken.MaxChairs {
+			writeError(w, http.StatusForbidden, errors.New("chair_register_token has reached its chair limit"))
+			return
+		}
+		if registerToken.Model != nil && *registerToken.Model != req.Model {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("chair_register_token only allows model %s", *registerToken.Model))
+			return
+		}
+
+		if _, err := tx.ExecContext(ctx, "db2", "UPDATE chair_register_tokens SET registered_chairs = registered_chairs + 1 WHERE token = ?", registerToken.Token); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.GetContext(ctx, "db2", owner, "SELECT * FROM owners WHERE id = ?", registerToken.OwnerID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
 	}
 
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 
-	_, err := h.db.ExecContext(
-		ctx,
+	_, err = tx.ExecContext(
+		ctx, "db1",
 		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
 		chairID, owner.ID, req.Name, req.Model, false, accessToken,
 	)
@@ -56,6 +93,13 @@ func (h *apiHandler) chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.chairGrid.setChair(Chair{ID: chairID, Name: req.Name, Model: req.Model, IsActive: false})
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "chair_session",
@@ -82,12 +126,34 @@ func (h *apiHandler) chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := h.db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	tx, err := h.db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
+
+	// オーナーが受付停止にしている間は、椅子から再開させない
+	var deactivatedByOwnerAt sql.NullTime
+	if err := tx.GetContext(ctx, &deactivatedByOwnerAt, "SELECT deactivated_by_owner_at FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if req.IsActive && deactivatedByOwnerAt.Valid {
+		writeError(w, http.StatusForbidden, errors.New("chair has been deactivated by its owner"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 	chairAccessTokenCache.Forget(chair.AccessToken)
+	h.chairGrid.setActive(chair.ID, req.IsActive)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -106,80 +172,14 @@ func (h *apiHandler) chairPostCoordinate(w http.ResponseWriter, r *http.Request)
 
 	chair := ctx.Value("chair").(*Chair)
 
-	tx, err := BeginMultiTx(h.db, h.db2)
+	locations, err := h.recordChairCoordinates(ctx, chair, []chairCoordinate{{Coordinate: *req}})
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
-
-	chairLocationID := ulid.Make().String()
-	if _, err := tx.tx1.ExecContext(
-		ctx,
-		`INSERT INTO chair_locations (id, chair_id, latitude, longitude) VALUES (?, ?, ?, ?)`,
-		chairLocationID, chair.ID, req.Latitude, req.Longitude,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	location := &ChairLocation{}
-	if err := tx.tx1.GetContext(ctx, location, `SELECT * FROM chair_locations WHERE id = ?`, chairLocationID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	ride := &Ride{}
-	afterCommit := afterCommitNop
-	if err := tx.tx1.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	} else {
-		status, err := h.getLatestRideStatus(ctx, tx.tx1, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if ac, err := h.createRideStatus(ctx, tx.tx1, ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				} else {
-					afterCommit = ac
-				}
-			}
-
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if ac, err := h.createRideStatus(ctx, tx.tx1, ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				} else {
-					af := afterCommit
-					afterCommit = func(ctx context.Context) error {
-						if err := af(ctx); err != nil {
-							return err
-						}
-						return ac(ctx)
-					}
-				}
-			}
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	if err := afterCommit(ctx); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
-		RecordedAt: location.CreatedAt.UnixMilli(),
+		RecordedAt: locations[0].CreatedAt.UnixMilli(),
 	})
 }
 
@@ -199,6 +199,17 @@ type chairGetNotificationResponseData struct {
 	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate `json:"destination_coordinate"`
 	Status                string     `json:"status"`
+	// CARRYING の間はまだ着いていない最初の地点から順に回ってから目的地に向かう
+	Waypoints []rideWaypointResponse `json:"waypoints,omitempty"`
+	// 相乗りしている相手のライド
+	SharedTrip *chairGetNotificationResponseSharedTrip `json:"shared_trip,omitempty"`
+}
+
+type chairGetNotificationResponseSharedTrip struct {
+	RideID                string     `json:"ride_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Status                string     `json:"status"`
 }
 
 func (h *apiHandler) chairGetNotification(w http.ResponseWriter, r *http.Request) {
@@ -211,10 +222,10 @@ func (h *apiHandler) chairGetNotification(w http.ResponseWriter, r *http.Request
 		return
 	}
 	defer tx.Rollback()
-	ride := &Ride{}
 	status := ""
 
-	if err := tx.GetContext(ctx, "db1", ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	rides, err := chairCurrentRides(ctx, tx.tx1, chair.ID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
 				RetryAfterMs: 100,
@@ -224,6 +235,31 @@ func (h *apiHandler) chairGetNotification(w http.ResponseWriter, r *http.Request
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	ride := &rides[0]
+	var sharedTrip *chairGetNotificationResponseSharedTrip
+	if len(rides) > 1 {
+		ride, err = h.chairNotificationRide(ctx, rides)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, partner := range rides {
+			if partner.ID == ride.ID {
+				continue
+			}
+			partnerStatus, err := h.getLatestRideStatus(ctx, tx.tx1, partner.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			sharedTrip = &chairGetNotificationResponseSharedTrip{
+				RideID:                partner.ID,
+				PickupCoordinate:      Coordinate{Latitude: partner.PickupLatitude, Longitude: partner.PickupLongitude},
+				DestinationCoordinate: Coordinate{Latitude: partner.DestinationLatitude, Longitude: partner.DestinationLongitude},
+				Status:                partnerStatus,
+			}
+		}
+	}
 
 	yetSentRideStatus, err := h.findRideStatusYetSentByChair(ctx, tx.tx1, ride.ID)
 	if err != nil {
@@ -248,6 +284,12 @@ func (h *apiHandler) chairGetNotification(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	waypoints, err := getRideWaypoints(ctx, tx.tx1, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	afterCommit := afterCommitNop
 	if yetSentRideStatus.ID != "" {
 		ac, err := h.updateRideStatusChairSentAt(ctx, tx.tx1, yetSentRideStatus.ID)
@@ -282,7 +324,9 @@ func (h *apiHandler) chairGetNotification(w http.ResponseWriter, r *http.Request
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Status: status,
+			Status:     status,
+			Waypoints:  newRideWaypointsResponse(waypoints),
+			SharedTrip: sharedTrip,
 		},
 		RetryAfterMs: 100,
 	})
@@ -365,6 +409,13 @@ func (h *apiHandler) chairPostRideStatus(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// 相乗りを選んだ利用者を乗せたら、目的地に着くまで次の利用者を受け付ける
+	if req.Status == "CARRYING" && ride.Pooled && !ride.PooledWith.Valid {
+		h.chairGrid.setPoolRide(chair.ID, &chairGridPoolRide{
+			RideID:      ride.ID,
+			Destination: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		})
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
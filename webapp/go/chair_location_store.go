@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 1回の送信にまとめる位置の上限
+const chairLocationPublishBatchSize = 500
+
+// chairLocationStore は椅子ごとの最新の位置をメモリに持つ。
+// API を受けるノードが複数あるときは、受け取った位置をほかのノードにも送って同じ内容に保つ
+type chairLocationStore struct {
+	mu        sync.RWMutex
+	locations map[string]ChairLocation
+
+	// 位置を送るほかのノード。ISUCON_CHAIR_LOCATION_PEERS にカンマ区切りで "http://192.168.0.12:8080" のように指定する
+	peers   []string
+	pending chan ChairLocation
+	client  *http.Client
+}
+
+func newChairLocationStore(peers []string) *chairLocationStore {
+	return &chairLocationStore{
+		locations: map[string]ChairLocation{},
+		peers:     peers,
+		pending:   make(chan ChairLocation, 4096),
+		client:    &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+func newChairLocationStoreFromEnv() *chairLocationStore {
+	peers := []string{}
+	for _, peer := range strings.Split(os.Getenv("ISUCON_CHAIR_LOCATION_PEERS"), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, strings.TrimSuffix(peer, "/"))
+		}
+	}
+	return newChairLocationStore(peers)
+}
+
+// chair_locations から椅子ごとの最新の位置を読み直す
+func (s *chairLocationStore) load(ctx context.Context, db *sqlx.DB) error {
+	latest := []ChairLocation{}
+	if err := db.SelectContext(ctx, &latest, `
+		SELECT id, chair_id, latitude, longitude, created_at
+		FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY chair_id ORDER BY created_at DESC) AS rn
+		      FROM chair_locations) tmp
+		WHERE rn = 1
+	`); err != nil {
+		return err
+	}
+
+	locations := make(map[string]ChairLocation, len(latest))
+	for _, location := range latest {
+		locations[location.ChairID] = location
+	}
+
+	s.mu.Lock()
+	s.locations = locations
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *chairLocationStore) get(chairID string) (ChairLocation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	location, ok := s.locations[chairID]
+	return location, ok
+}
+
+// 記録済みの位置より古いものでは上書きしない。上書きしたかを返す
+func (s *chairLocationStore) set(location ChairLocation) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.locations[location.ChairID]; ok && current.CreatedAt.After(location.CreatedAt) {
+		return false
+	}
+	s.locations[location.ChairID] = location
+	return true
+}
+
+// 全椅子の最新の位置の写し
+func (s *chairLocationStore) snapshot() map[string]ChairLocation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	locations := make(map[string]ChairLocation, len(s.locations))
+	for chairID, location := range s.locations {
+		locations[chairID] = location
+	}
+	return locations
+}
+
+// ほかのノードに送る位置を積む。送信が詰まっているときは捨て、そのノードは次の位置で追いつく
+func (s *chairLocationStore) publish(location ChairLocation) {
+	if len(s.peers) == 0 {
+		return
+	}
+	select {
+	case s.pending <- location:
+	default:
+		slog.Warn("dropped chair location for peers", "chair_id", location.ChairID)
+	}
+}
+
+// 積まれた位置をまとめてほかのノードに送り続ける
+func (s *chairLocationStore) startPublisher(ctx context.Context) {
+	if len(s.peers) == 0 {
+		return
+	}
+	go func() {
+		for {
+			var first ChairLocation
+			select {
+			case <-ctx.Done():
+				return
+			case first = <-s.pending:
+			}
+			batch := []ChairLocation{first}
+		drain:
+			for len(batch) < chairLocationPublishBatchSize {
+				select {
+				case location := <-s.pending:
+					batch = append(batch, location)
+				default:
+					break drain
+				}
+			}
+			for _, peer := range s.peers {
+				if err := s.send(ctx, peer, batch); err != nil {
+					slog.Error("failed to send chair locations to peer", "peer", peer, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *chairLocationStore) send(ctx context.Context, peer string, locations []ChairLocation) error {
+	body, err := json.Marshal(locations)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, peer+"/api/internal/chair-locations", body)
+}
+
+// 初期化でデータが入れ替わったので、ほかのノードにも位置を読み直させる
+func (s *chairLocationStore) reloadPeers(ctx context.Context) error {
+	for _, peer := range s.peers {
+		if err := s.post(ctx, peer+"/api/internal/chair-locations/reload", nil); err != nil {
+			return fmt.Errorf("failed to reload chair locations on %s: %w", peer, err)
+		}
+	}
+	return nil
+}
+
+func (s *chairLocationStore) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		responseBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("peer returned status %d: %s", resp.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+func (h *apiHandler) initChairLocationStore(ctx context.Context) error {
+	return h.chairLocations.load(ctx, h.db)
+}
+
+// 椅子の最新の位置をメモリ上の状態に反映する。自分で記録した位置もほかのノードから届いた位置もここを通す
+func (h *apiHandler) applyChairLocation(location ChairLocation) {
+	if !h.chairLocations.set(location) {
+		return
+	}
+	h.serviceArea.recordChairLocation(location.ChairID, location)
+	h.chairGrid.setLocation(location.ChairID, Coordinate{Latitude: location.Latitude, Longitude: location.Longitude})
+}
+
+// ほかのノードが記録した椅子の位置を受け取る
+func (h *apiHandler) internalPostChairLocations(w http.ResponseWriter, r *http.Request) {
+	locations := []ChairLocation{}
+	if err := bindJSON(r, &locations); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, location := range locations {
+		h.applyChairLocation(location)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 初期化したノードから呼ばれ、位置とそれを使うグリッド・営業エリアを DB から作り直す
+func (h *apiHandler) internalPostChairLocationsReload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := h.initChairLocationStore(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initChairGrid(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initServiceArea(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChairLocationStoreSet(t *testing.T) {
+	s := newChairLocationStore(nil)
+	base := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	if !s.set(ChairLocation{ChairID: "chair", Latitude: 1, CreatedAt: base}) {
+		t.Fatal("first location should be stored")
+	}
+	if s.set(ChairLocation{ChairID: "chair", Latitude: 2, CreatedAt: base.Add(-time.Second)}) {
+		t.Fatal("older location should not overwrite")
+	}
+	if !s.set(ChairLocation{ChairID: "chair", Latitude: 3, CreatedAt: base.Add(time.Second)}) {
+		t.Fatal("newer location should overwrite")
+	}
+	if location, _ := s.get("chair"); location.Latitude != 3 {
+		t.Fatalf("latitude = %d, want 3", location.Latitude)
+	}
+}
+
+// 位置を記録したノードから、ほかのノードのストアとグリッドに届く
+func TestChairLocationStorePublish(t *testing.T) {
+	peer := &apiHandler{chairLocations: newChairLocationStore(nil), chairGrid: newChairGrid(), serviceArea: newServiceArea()}
+	peer.chairGrid.reset([]*chairGridState{{ID: "chair", Active: true}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/internal/chair-locations", peer.internalPostChairLocations)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newChairLocationStore([]string{server.URL})
+	s.startPublisher(ctx)
+	s.publish(ChairLocation{ChairID: "chair", Latitude: 10, Longitude: 20, CreatedAt: time.Now()})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if location, ok := peer.chairLocations.get("chair"); ok {
+			if location.Latitude != 10 || location.Longitude != 20 {
+				t.Fatalf("location = %+v, want (10, 20)", location)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("location did not reach the peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(peer.chairGrid.nearby(Coordinate{Latitude: 10, Longitude: 20}, 0, false)) != 1 {
+		t.Fatal("peer grid should index the chair at the published location")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// 椅子が1回の移動で進む間隔。speed は1回あたりに進む距離
+func newChairTickFromEnv() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_CHAIR_TICK_MS")); err == nil && v > 0 {
+		return time.Duration(v) * time.Millisecond
+	}
+	return time.Second
+}
+
+// from から to までマンハッタン距離で進むのにかかる時間(ミリ秒)。モデルの速度がわからなければ nil
+func (h *apiHandler) estimateArrivalMs(model string, from, to Coordinate) *int64 {
+	return h.estimateTravelMs(model, calculateDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude))
+}
+
+// distance だけ進むのにかかる時間(ミリ秒)。モデルの速度がわからなければ nil
+func (h *apiHandler) estimateTravelMs(model string, distance int) *int64 {
+	speed, ok := h.pricing.speedFor(model)
+	if !ok || speed <= 0 {
+		return nil
+	}
+	ticks := (distance + speed - 1) / speed
+	eta := (time.Duration(ticks) * h.chairTick).Milliseconds()
+	return &eta
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSE の接続を保つためのコメントを送る間隔
+const fleetHeartbeatInterval = 15 * time.Second
+
+type fleetChair struct {
+	ID                string      `json:"id"`
+	Name              string      `json:"name"`
+	Model             string      `json:"model"`
+	Active            bool        `json:"active"`
+	Coordinate        *Coordinate `json:"coordinate"`
+	RideStatus        *string     `json:"ride_status"`
+	LastUpdatedAt     *int64      `json:"last_updated_at"`
+	SinceLastUpdateMs *int64      `json:"since_last_update_ms"`
+	OutOfServiceArea  bool        `json:"out_of_service_area"`
+	Stale             bool        `json:"stale"`
+}
+
+type fleetEvent struct {
+	OwnerID    string
+	Chair      Chair
+	Coordinate Coordinate
+	RideStatus *string
+	RecordedAt time.Time
+}
+
+func (e fleetEvent) fleetChair(now time.Time) fleetChair {
+	return newFleetChair(e.Chair, &e.Coordinate, e.RecordedAt, e.RideStatus, now)
+}
+
+func newFleetChair(chair Chair, coordinate *Coordinate, recordedAt time.Time, rideStatus *string, now time.Time) fleetChair {
+	c := fleetChair{
+		ID:         chair.ID,
+		Name:       chair.Name,
+		Model:      chair.Model,
+		Active:     chair.IsActive,
+		Coordinate: coordinate,
+		RideStatus: rideStatus,
+	}
+	if coordinate != nil {
+		updatedAt := recordedAt.UnixMilli()
+		since := max(now.Sub(recordedAt), 0).Milliseconds()
+		c.LastUpdatedAt = &updatedAt
+		c.SinceLastUpdateMs = &since
+	}
+	return c
+}
+
+// fleetBroker は椅子の位置更新をオーナーごとの購読者に配る。プロセス内だけで完結する
+type fleetBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan fleetEvent]struct{}
+}
+
+func newFleetBroker() *fleetBroker {
+	return &fleetBroker{
+		subscribers: map[string]map[chan fleetEvent]struct{}{},
+	}
+}
+
+func (b *fleetBroker) subscribe(ownerID string) (<-chan fleetEvent, func()) {
+	ch := make(chan fleetEvent, 64)
+	b.mu.Lock()
+	if _, ok := b.subscribers[ownerID]; !ok {
+		b.subscribers[ownerID] = map[chan fleetEvent]struct{}{}
+	}
+	b.subscribers[ownerID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		delete(b.subscribers[ownerID], ch)
+		if len(b.subscribers[ownerID]) == 0 {
+			delete(b.subscribers, ownerID)
+		}
+		b.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+// 受け取りが詰まっている購読者には送らない。位置は次の更新で追いつく
+func (b *fleetBroker) publish(event fleetEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.OwnerID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// オーナーの全椅子の最新の位置と、進行中のライドの状態を返す
+func (h *apiHandler) getFleet(r *http.Request, owner *Owner) ([]fleetChair, error) {
+	ctx := r.Context()
+
+	chairs := []Chair{}
+	if err := h.db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? AND retired_at IS NULL ORDER BY id", owner.ID); err != nil {
+		return nil, err
+	}
+	if len(chairs) == 0 {
+		return []fleetChair{}, nil
+	}
+	// 相乗り中は最新のライドが先に終わっていることがあるので、椅子ごとに相手のライドまで見る
+	rideStatusByChairID := make(map[string]*string, len(chairs))
+	for _, chair := range chairs {
+		status, err := h.chairActiveRideStatus(ctx, h.db, chair.ID)
+		if err != nil {
+			return nil, err
+		}
+		rideStatusByChairID[chair.ID] = status
+	}
+
+	now := time.Now()
+	fleet := make([]fleetChair, 0, len(chairs))
+	for _, chair := range chairs {
+		var coordinate *Coordinate
+		var recordedAt time.Time
+		if location, ok := h.chairLocations.get(chair.ID); ok {
+			coordinate = &Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}
+			recordedAt = location.CreatedAt
+		}
+		c := newFleetChair(chair, coordinate, recordedAt, rideStatusByChairID[chair.ID], now)
+		c.OutOfServiceArea = h.serviceArea.chairOutOfArea(chair.ID)
+		c.Stale = h.chairGrid.isStale(chair.ID)
+		fleet = append(fleet, c)
+	}
+	return fleet, nil
+}
+
+type ownerGetFleetResponse struct {
+	Chairs []fleetChair `json:"chairs"`
+}
+
+// オーナーの椅子の現在地の一覧。?stream=1 か Accept: text/event-stream なら SSE で位置の更新を流し続ける
+func (h *apiHandler) ownerGetFleet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	stream := r.URL.Query().Get("stream") == "1" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if !stream {
+		fleet, err := h.getFleet(r, owner)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ownerGetFleetResponse{Chairs: fleet})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	// スナップショットを取る前に購読しておき、その間の更新を取りこぼさないようにする
+	events, unsubscribe := h.fleet.subscribe(owner.ID)
+	defer unsubscribe()
+
+	fleet, err := h.getFleet(r, owner)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeSSE(w, "snapshot", ownerGetFleetResponse{Chairs: fleet}); err != nil {
+		slog.Error("failed to write fleet snapshot", "error", err)
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(fleetHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			c := event.fleetChair(time.Now())
+			c.OutOfServiceArea = h.serviceArea.chairOutOfArea(c.ID)
+			c.Stale = h.chairGrid.isStale(c.ID)
+			if err := writeSSE(w, "chair", c); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
@@ -11,7 +11,7 @@ func (h *apiHandler) internalGetMatching(w http.ResponseWriter, r *http.Request)
 	ctx := r.Context()
 	// MEMO: 一旦最も待たせているリクエストに適当な空いている椅子マッチさせる実装とする。おそらくもっといい方法があるはず…
 	ride := &Ride{}
-	if err := h.db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
+	if err := h.db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL AND dormant = FALSE ORDER BY created_at LIMIT 1`); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -20,18 +20,35 @@ func (h *apiHandler) internalGetMatching(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// 相乗りを選んだライドは、まず乗車中の椅子に相乗りさせられないか探す
+	if ride.Pooled {
+		if pooled, err := h.matchPooledRide(ctx, ride); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if pooled {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
 	matched := &Chair{}
 	empty := false
 	for i := 0; i < 10; i++ { // N+1
-		if err := h.db.GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN (SELECT id FROM chairs WHERE is_active = TRUE ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1"); err != nil {
+		if err := h.db.GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN (SELECT id FROM chairs WHERE is_active = TRUE AND retired_at IS NULL ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1"); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
 		}
+		// 位置の送信が途絶えている椅子には割り当てない
+		if h.chairGrid.isStale(matched.ID) {
+			empty = false
+			continue
+		}
 
-		if err := h.db.GetContext(ctx, &empty, "SELECT COUNT(*) = 0 FROM (SELECT COUNT(chair_sent_at) = 6 AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", matched.ID); err != nil {
+		// 配車し直したライドは状態の数が変わるので、COMPLETED を椅子に通知済みかどうかで完了を判定する
+		if err := h.db.GetContext(ctx, &empty, "SELECT COUNT(*) = 0 FROM (SELECT MAX(status = 'COMPLETED' AND chair_sent_at IS NOT NULL) AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", matched.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -44,10 +61,20 @@ func (h *apiHandler) internalGetMatching(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if _, err := h.db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
+	price, err := h.priceRideForModel(ctx, h.db, ride, matched.Model)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := h.db.ExecContext(
+		ctx,
+		"UPDATE rides SET chair_id = ?, fare = ?, discount = ?, pool_discount = ?, initial_fare = ?, fare_per_distance = ? WHERE id = ?",
+		matched.ID, price.Fare, price.Discount, price.PoolDiscount, price.Rate.InitialFare, price.Rate.FarePerDistance, ride.ID,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	h.chairGrid.setBusy(matched.ID, true)
 
 	w.WriteHeader(http.StatusNoContent)
 }
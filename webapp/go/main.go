@@ -15,6 +15,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -26,13 +27,18 @@ import (
 // var db *sqlx.DB
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1]))
+	}
+
 	go standalone.Integrate(":8888")
 	mux := setup()
 	slog.Info("Listening on :8080")
 	http.ListenAndServe(":8080", mux)
 }
 
-func setup() http.Handler {
+// DB1, DB2 に接続する。接続できなければ panic する
+func connectDBs() (*sqlx.DB, *sqlx.DB) {
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -111,7 +117,16 @@ func setup() http.Handler {
 		panic(err)
 	}
 
+	return db, db2
+}
+
+func setup() http.Handler {
+	db, db2 := connectDBs()
+
 	h := newHandler(db, db2)
+	if err := h.initPricingEngine(context.Background()); err != nil {
+		slog.Error("failed to load fare rates", "error", err)
+	}
 	mux := chi.NewRouter()
 	// mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
@@ -121,6 +136,21 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/db/initialize", h.dbInitialize)
 		return mux
 	}
+	if err := h.initQuoteSigner(context.Background()); err != nil {
+		slog.Error("failed to load quote signing key", "error", err)
+	}
+	if err := h.initChairLocationStore(context.Background()); err != nil {
+		slog.Error("failed to load chair locations", "error", err)
+	}
+	if err := h.initChairGrid(context.Background()); err != nil {
+		slog.Error("failed to build chair grid", "error", err)
+	}
+	if err := h.initServiceArea(context.Background()); err != nil {
+		slog.Error("failed to load service area", "error", err)
+	}
+	h.chairLocations.startPublisher(context.Background())
+	h.startStaleChairSweeper(context.Background())
+	h.startScheduledRideActivator(context.Background())
 	mux.HandleFunc("POST /api/initialize", h.postInitialize)
 
 	// app handlers
@@ -132,9 +162,15 @@ func setup() http.Handler {
 		authedMux.HandleFunc("GET /api/app/rides", h.appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", h.appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", h.appPostRidesEstimatedFare)
+		authedMux.HandleFunc("GET /api/app/rides/scheduled", h.appGetScheduledRides)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}", h.appGetRide)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", h.appPostScheduledRideCancel)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", h.appPostRideEvaluatation)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/receipt", h.appGetRideReceipt)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/path", h.appGetRidePath)
 		authedMux.HandleFunc("GET /api/app/notification", h.appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", h.appGetNearbyChairs)
+		authedMux.HandleFunc("GET /api/app/service-area", h.appGetServiceArea)
 	}
 
 	// owner handlers
@@ -142,8 +178,27 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/owner/owners", h.ownerPostOwners)
 
 		authedMux := mux.With(h.ownerAuthMiddleware)
+		authedMux.HandleFunc("POST /api/owner/chair-register-token", h.ownerPostChairRegisterToken)
+		authedMux.HandleFunc("GET /api/owner/chair-register-tokens", h.ownerGetChairRegisterTokens)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens", h.ownerPostChairRegisterTokens)
+		authedMux.HandleFunc("DELETE /api/owner/chair-register-tokens/{token}", h.ownerDeleteChairRegisterToken)
 		authedMux.HandleFunc("GET /api/owner/sales", h.ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/export", h.ownerGetSalesExport)
+		authedMux.HandleFunc("GET /api/owner/earnings", h.ownerGetEarnings)
+		authedMux.HandleFunc("GET /api/owner/fleet", h.ownerGetFleet)
+		authedMux.HandleFunc("GET /api/owner/notifications", h.ownerGetNotifications)
+		authedMux.HandleFunc("GET /api/owner/rides/{ride_id}/path", h.ownerGetRidePath)
+		authedMux.HandleFunc("GET /api/owner/payouts", h.ownerGetPayouts)
+		authedMux.HandleFunc("POST /api/owner/payouts", h.ownerPostPayout)
 		authedMux.HandleFunc("GET /api/owner/chairs", h.ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/export", h.ownerGetChairsExport)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}", h.ownerGetChairDetail)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/path", h.ownerGetChairPath)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", h.ownerPatchChair)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/activate", h.ownerPostChairActivate)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/deactivate", h.ownerPostChairDeactivate)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/retire", h.ownerPostChairRetire)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/access-token", h.ownerPostChairAccessToken)
 	}
 
 	// chair handlers
@@ -153,13 +208,18 @@ func setup() http.Handler {
 		authedMux := mux.With(h.chairAuthMiddleware)
 		authedMux.HandleFunc("POST /api/chair/activity", h.chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", h.chairPostCoordinate)
+		authedMux.HandleFunc("POST /api/chair/coordinates", h.chairPostCoordinates)
 		authedMux.HandleFunc("GET /api/chair/notification", h.chairGetNotification)
+		authedMux.HandleFunc("GET /api/chair/rides/{ride_id}", h.chairGetRide)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", h.chairPostRideStatus)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", h.internalGetMatching)
+		mux.HandleFunc("POST /api/internal/payouts/{payout_id}/paid", h.internalPostPayoutPaid)
+		mux.HandleFunc("POST /api/internal/chair-locations", h.internalPostChairLocations)
+		mux.HandleFunc("POST /api/internal/chair-locations/reload", h.internalPostChairLocationsReload)
 	}
 
 	return mux
@@ -263,6 +323,17 @@ type apiHandler struct {
 	db2               *sqlx.DB
 	paymentGatewayURL string
 	rideStatus        *rideStatusManager
+	pricing           *pricingEngine
+	surge             surgeConfig
+	quoteSigner       *quoteSigner
+	fleet             *fleetBroker
+	chairLocations    *chairLocationStore
+	chairGrid         *chairGrid
+	chairTick         time.Duration
+	serviceArea       *serviceArea
+	staleChair        staleChairConfig
+	scheduledRides    scheduledRideConfig
+	pool              poolConfig
 }
 
 func newHandler(db *sqlx.DB, db2 *sqlx.DB) *apiHandler {
@@ -272,7 +343,19 @@ func newHandler(db *sqlx.DB, db2 *sqlx.DB) *apiHandler {
 		// dummy
 		paymentGatewayURL: "http://localhost:12345",
 		// NOTE: ここではrideStatusを初期化していない
-		rideStatus: nil,
+		rideStatus:  nil,
+		pricing:     newPricingEngine(),
+		surge:       newSurgeConfigFromEnv(),
+		quoteSigner: newQuoteSigner(nil),
+		fleet:       newFleetBroker(),
+		// 位置は起動時と初期化時に読み込む
+		chairLocations: newChairLocationStoreFromEnv(),
+		chairGrid:      newChairGrid(),
+		chairTick:      newChairTickFromEnv(),
+		serviceArea:    newServiceArea(),
+		staleChair:     newStaleChairConfigFromEnv(),
+		scheduledRides: newScheduledRideConfigFromEnv(),
+		pool:           newPoolConfigFromEnv(),
 	}
 }
 
@@ -308,14 +391,45 @@ func (h *apiHandler) postInitialize(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.initRideStatusManager(ctx); err != nil {
-		slog.Error("failed to initialize ride status manager", err)
+		slog.Error("failed to initialize ride status manager", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initPricingEngine(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// settings を作り直したので鍵も作り直す
+	if err := h.initQuoteSigner(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initChairLocationStore(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initChairGrid(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initServiceArea(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.chairLocations.reloadPeers(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 	// サーバー2に dbInitialize をリクエスト
 	if err := forwardDbInitializeRequest2(req.PaymentServer); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to forward to dbInitialize: %w", err))
 		return
 	}
+	// クーポンを読むので、両方の DB を初期化し終えてから行う
+	if _, err := backfillRideCoupons(ctx, h.db, h.db2); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
 }
@@ -385,7 +499,11 @@ func (h *apiHandler) dbInitialize(w http.ResponseWriter, r *http.Request) {
 	h.paymentGatewayURL = req.PaymentServer
 
 	if err := h.initRideStatusManager(ctx); err != nil {
-		slog.Error("failed to initialize ride status manager", err)
+		slog.Error("failed to initialize ride status manager", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.initPricingEngine(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -424,7 +542,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "error", err)
 }
 
 func secureRandomStr(b int) string {
@@ -68,7 +68,8 @@ var chairAccessTokenCache = sc.NewMust(func(ctx context.Context, token string) (
 	db := ctx.Value(cacheCtxDBKeyVal).(*sqlx.DB)
 
 	chair := &Chair{}
-	if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE access_token = ?`, token); err != nil {
+	// 引退した椅子はもう認証しない
+	if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE access_token = ? AND retired_at IS NULL`, token); err != nil {
 		return nil, err
 	}
 	return chair, nil
@@ -6,19 +6,25 @@ import (
 )
 
 type Chair struct {
-	ID          string    `db:"id"`
-	OwnerID     string    `db:"owner_id"`
-	Name        string    `db:"name"`
-	Model       string    `db:"model"`
-	IsActive    bool      `db:"is_active"`
-	AccessToken string    `db:"access_token"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	ID                     string       `db:"id"`
+	OwnerID                string       `db:"owner_id"`
+	Name                   string       `db:"name"`
+	Model                  string       `db:"model"`
+	IsActive               bool         `db:"is_active"`
+	AccessToken            string       `db:"access_token"`
+	CreatedAt              time.Time    `db:"created_at"`
+	UpdatedAt              time.Time    `db:"updated_at"`
+	RetiredAt              sql.NullTime `db:"retired_at"`
+	TotalDistance          int          `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	DeactivatedByOwnerAt   sql.NullTime `db:"deactivated_by_owner_at"`
 }
 
 type ChairModel struct {
-	Name  string `db:"name"`
-	Speed int    `db:"speed"`
+	Name            string `db:"name"`
+	Speed           int    `db:"speed"`
+	InitialFare     int    `db:"initial_fare"`
+	FarePerDistance int    `db:"fare_per_distance"`
 }
 
 type ChairLocation struct {
@@ -58,6 +64,18 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	SurgeRate            int            `db:"surge_rate"`
+	Fare                 int            `db:"fare"`
+	Discount             int            `db:"discount"`
+	CouponCode           *string        `db:"coupon_code"`
+	ScheduledAt          sql.NullTime   `db:"scheduled_at"`
+	Dormant              bool           `db:"dormant"`
+	Pooled               bool           `db:"pooled"`
+	PoolDiscount         int            `db:"pool_discount"`
+	PooledWith           sql.NullString `db:"pooled_with"`
+	InitialFare          int            `db:"initial_fare"`
+	FarePerDistance      int            `db:"fare_per_distance"`
+	PriceLocked          bool           `db:"price_locked"`
 }
 
 type RideStatus struct {
@@ -78,6 +96,57 @@ type Owner struct {
 	UpdatedAt          time.Time `db:"updated_at"`
 }
 
+type ChairRegisterToken struct {
+	Token            string       `db:"token"`
+	OwnerID          string       `db:"owner_id"`
+	Model            *string      `db:"model"`
+	MaxChairs        *int         `db:"max_chairs"`
+	RegisteredChairs int          `db:"registered_chairs"`
+	ExpiresAt        sql.NullTime `db:"expires_at"`
+	CreatedAt        time.Time    `db:"created_at"`
+}
+
+type PayoutStatement struct {
+	ID             string       `db:"id"`
+	OwnerID        string       `db:"owner_id"`
+	PeriodSince    time.Time    `db:"period_since"`
+	PeriodUntil    time.Time    `db:"period_until"`
+	CommissionRate int          `db:"commission_rate"`
+	Rides          int          `db:"rides"`
+	Gross          int          `db:"gross"`
+	Commission     int          `db:"commission"`
+	Net            int          `db:"net"`
+	Status         string       `db:"status"`
+	PaidAt         sql.NullTime `db:"paid_at"`
+	CreatedAt      time.Time    `db:"created_at"`
+}
+
+type PayoutStatementChair struct {
+	StatementID string `db:"statement_id"`
+	ChairID     string `db:"chair_id"`
+	Rides       int    `db:"rides"`
+	Gross       int    `db:"gross"`
+	Commission  int    `db:"commission"`
+	Net         int    `db:"net"`
+}
+
+type RideWaypoint struct {
+	RideID    string       `db:"ride_id"`
+	Position  int          `db:"position"`
+	Latitude  int          `db:"latitude"`
+	Longitude int          `db:"longitude"`
+	ArrivedAt sql.NullTime `db:"arrived_at"`
+}
+
+type OwnerNotification struct {
+	ID        string    `db:"id"`
+	OwnerID   string    `db:"owner_id"`
+	ChairID   string    `db:"chair_id"`
+	Kind      string    `db:"kind"`
+	Message   string    `db:"message"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
 type Coupon struct {
 	UserID    string    `db:"user_id"`
 	Code      string    `db:"code"`
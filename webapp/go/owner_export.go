@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+)
+
+// CSVの日時はスプレッドシートで扱いやすいようにDBと同じ表記にする
+const exportCSVTimeLayout = "2006-01-02 15:04:05.000000"
+
+// ?format= を優先し、無ければ Accept ヘッダから決める。どちらも無ければCSV
+func exportFormat(r *http.Request) (string, error) {
+	switch r.URL.Query().Get("format") {
+	case exportFormatCSV:
+		return exportFormatCSV, nil
+	case exportFormatJSONL:
+		return exportFormatJSONL, nil
+	case "":
+	default:
+		return "", errors.New("format must be csv or jsonl")
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/x-ndjson") || strings.Contains(accept, "application/jsonl") {
+		return exportFormatJSONL, nil
+	}
+	return exportFormatCSV, nil
+}
+
+type exportRecord interface {
+	csvRecord() []string
+}
+
+// rows を1行ずつ読みながら書き出す。全件をメモリに載せない
+func streamExport[T exportRecord](w http.ResponseWriter, format string, filename string, csvHeader []string, rows *sqlx.Rows) {
+	defer rows.Close()
+
+	if format == exportFormatJSONL {
+		w.Header().Set("Content-Type", "application/x-ndjson;charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.jsonl"`)
+	} else {
+		w.Header().Set("Content-Type", "text/csv;charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	jsonEncoder := json.NewEncoder(w)
+	if format == exportFormatCSV {
+		csvWriter.Write(csvHeader)
+	}
+
+	count := 0
+	for rows.Next() {
+		var record T
+		if err := rows.StructScan(&record); err != nil {
+			// ヘッダーは送信済みなので途中で打ち切るしかない
+			slog.Error("failed to scan export row", "error", err)
+			return
+		}
+		if format == exportFormatJSONL {
+			if err := jsonEncoder.Encode(record); err != nil {
+				slog.Error("failed to write export row", "error", err)
+				return
+			}
+		} else {
+			csvWriter.Write(record.csvRecord())
+		}
+
+		count++
+		if count%1000 == 0 {
+			csvWriter.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	csvWriter.Flush()
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read export rows", "error", err)
+	}
+}
+
+type salesExportRecord struct {
+	RideID                string    `db:"ride_id" json:"ride_id"`
+	ChairID               string    `db:"chair_id" json:"chair_id"`
+	ChairName             string    `db:"chair_name" json:"chair_name"`
+	Model                 string    `db:"model" json:"model"`
+	PickupLatitude        int       `db:"pickup_latitude" json:"pickup_latitude"`
+	PickupLongitude       int       `db:"pickup_longitude" json:"pickup_longitude"`
+	DestinationLatitude   int       `db:"destination_latitude" json:"destination_latitude"`
+	DestinationLongitude  int       `db:"destination_longitude" json:"destination_longitude"`
+	Distance              int       `db:"distance" json:"distance"`
+	Fare                  int       `db:"fare" json:"fare"`
+	RequestedAt           time.Time `db:"requested_at" json:"-"`
+	CompletedAt           time.Time `db:"completed_at" json:"-"`
+	RequestedAtUnixMillis int64     `db:"-" json:"requested_at"`
+	CompletedAtUnixMillis int64     `db:"-" json:"completed_at"`
+}
+
+var salesExportCSVHeader = []string{
+	"ride_id", "chair_id", "chair_name", "model",
+	"pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude",
+	"distance", "fare", "requested_at", "completed_at",
+}
+
+func (r salesExportRecord) csvRecord() []string {
+	return []string{
+		r.RideID, r.ChairID, r.ChairName, r.Model,
+		strconv.Itoa(r.PickupLatitude), strconv.Itoa(r.PickupLongitude),
+		strconv.Itoa(r.DestinationLatitude), strconv.Itoa(r.DestinationLongitude),
+		strconv.Itoa(r.Distance), strconv.Itoa(r.Fare),
+		r.RequestedAt.Format(exportCSVTimeLayout), r.CompletedAt.Format(exportCSVTimeLayout),
+	}
+}
+
+func (r salesExportRecord) MarshalJSON() ([]byte, error) {
+	type plain salesExportRecord
+	r.RequestedAtUnixMillis = r.RequestedAt.UnixMilli()
+	r.CompletedAtUnixMillis = r.CompletedAt.UnixMilli()
+	return json.Marshal(plain(r))
+}
+
+// 完了したライドを1件1行で書き出す。since/until は ownerGetSales と同じ
+func (h *apiHandler) ownerGetSalesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	format, err := exportFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+
+	rows, err := h.db.QueryxContext(ctx, `
+		SELECT
+			rides.id AS ride_id,
+			chairs.id AS chair_id,
+			chairs.name AS chair_name,
+			chairs.model,
+			rides.pickup_latitude,
+			rides.pickup_longitude,
+			rides.destination_latitude,
+			rides.destination_longitude,
+			ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude) AS distance,
+			rides.fare,
+			rides.created_at AS requested_at,
+			rides.updated_at AS completed_at
+		FROM chairs
+		JOIN rides ON rides.chair_id = chairs.id
+		JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+		WHERE chairs.owner_id = ? AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		ORDER BY rides.updated_at
+	`, owner.ID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	streamExport[salesExportRecord](w, format, "sales", salesExportCSVHeader, rows)
+}
+
+type chairExportRecord struct {
+	ID       string `db:"id" json:"id"`
+	Name     string `db:"name" json:"name"`
+	Model    string `db:"model" json:"model"`
+	IsActive bool   `db:"is_active" json:"active"`
+	// これまでの総移動距離
+	TotalDistance int `db:"total_distance" json:"total_distance"`
+	// 完了したライドの売上の合計
+	Sales        int       `db:"sales" json:"sales"`
+	CreatedAt    time.Time `db:"created_at" json:"-"`
+	UpdatedAt    time.Time `db:"updated_at" json:"-"`
+	RegisteredAt int64     `db:"-" json:"registered_at"`
+	LastUpdateAt int64     `db:"-" json:"updated_at"`
+}
+
+var chairExportCSVHeader = []string{"id", "name", "model", "is_active", "total_distance", "sales", "created_at", "updated_at"}
+
+func (r chairExportRecord) csvRecord() []string {
+	return []string{
+		r.ID, r.Name, r.Model, strconv.FormatBool(r.IsActive),
+		strconv.Itoa(r.TotalDistance), strconv.Itoa(r.Sales),
+		r.CreatedAt.Format(exportCSVTimeLayout), r.UpdatedAt.Format(exportCSVTimeLayout),
+	}
+}
+
+func (r chairExportRecord) MarshalJSON() ([]byte, error) {
+	type plain chairExportRecord
+	r.RegisteredAt = r.CreatedAt.UnixMilli()
+	r.LastUpdateAt = r.UpdatedAt.UnixMilli()
+	return json.Marshal(plain(r))
+}
+
+// オーナーの椅子を1台1行で書き出す。アクセストークンは含めない
+func (h *apiHandler) ownerGetChairsExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	format, err := exportFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+
+	// 売上は ownerGetSales と同じく完了したライドの運賃を合計する
+	rows, err := h.db.QueryxContext(ctx, `
+		SELECT
+			chairs.id,
+			chairs.name,
+			chairs.model,
+			chairs.is_active,
+			chairs.total_distance,
+			IFNULL(sales.sales, 0) AS sales,
+			chairs.created_at,
+			chairs.updated_at
+		FROM chairs
+		LEFT JOIN (
+			SELECT rides.chair_id, SUM(rides.fare) AS sales
+			FROM rides
+			JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+			WHERE rides.chair_id IN (SELECT id FROM chairs WHERE owner_id = ?)
+			GROUP BY rides.chair_id
+		) sales ON sales.chair_id = chairs.id
+		WHERE chairs.owner_id = ?
+		ORDER BY chairs.id
+	`, owner.ID, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	streamExport[chairExportRecord](w, format, "chairs", chairExportCSVHeader, rows)
+}
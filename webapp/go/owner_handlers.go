@@ -2,6 +2,7 @@ package main
 
 import (
 	"cmp"
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
@@ -9,15 +10,9 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
-const (
-	initialFare     = 500
-	farePerDistance = 100
-)
-
 type ownerPostOwnersRequest struct {
 	Name string `json:"name"`
 }
@@ -66,117 +61,165 @@ func (h *apiHandler) ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 }
 
 type chairSales struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Sales int    `json:"sales"`
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Sales   int           `json:"sales"`
+	Buckets []salesBucket `json:"buckets,omitempty"`
 }
 
 type modelSales struct {
-	Model string `json:"model"`
-	Sales int    `json:"sales"`
+	Model   string        `json:"model"`
+	Sales   int           `json:"sales"`
+	Buckets []salesBucket `json:"buckets,omitempty"`
+}
+
+type salesBucket struct {
+	// バケットの開始時刻(unix ms)
+	Start int64 `json:"start"`
+	Sales int   `json:"sales"`
 }
 
 type ownerGetSalesResponse struct {
-	TotalSales int          `json:"total_sales"`
-	Chairs     []chairSales `json:"chairs"`
-	Models     []modelSales `json:"models"`
+	TotalSales  int           `json:"total_sales"`
+	Granularity string        `json:"granularity,omitempty"`
+	Buckets     []salesBucket `json:"buckets,omitempty"`
+	Chairs      []chairSales  `json:"chairs"`
+	Models      []modelSales  `json:"models"`
 }
 
-func (h *apiHandler) ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// granularity ごとのバケット開始時刻を求めるSQL式。週は月曜始まり
+var salesBucketExprs = map[string]string{
+	"hour":  "DATE_FORMAT(rides.updated_at, '%Y-%m-%d %H:00:00')",
+	"day":   "DATE(rides.updated_at)",
+	"week":  "DATE_SUB(DATE(rides.updated_at), INTERVAL WEEKDAY(rides.updated_at) DAY)",
+	"month": "DATE_FORMAT(rides.updated_at, '%Y-%m-01')",
+}
+
+type chairSalesRow struct {
+	ChairID   string       `db:"chair_id"`
+	ChairName string       `db:"chair_name"`
+	Model     string       `db:"model"`
+	Bucket    sql.NullTime `db:"bucket"`
+	Sales     int          `db:"sales"`
+}
+
+// since/until クエリ(unix ms)を読む。指定が無ければ全期間
+func parseSalesPeriod(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		until = time.UnixMilli(parsed)
 	}
+	return since, until, nil
+}
 
-	owner := r.Context().Value("owner").(*Owner)
-
-	tx, err := BeginMultiTx(h.db, h.db2)
+func (h *apiHandler) ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesPeriod(r)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx.Rollback()
+	granularity := r.URL.Query().Get("granularity")
+	bucketExpr := "NULL"
+	if granularity != "" {
+		expr, ok := salesBucketExprs[granularity]
+		if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("granularity must be one of hour, day, week, month"))
+			return
+		}
+		bucketExpr = expr
+	}
 
-	chairs := []Chair{}
-	if err := tx.tx1.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	owner := r.Context().Value("owner").(*Owner)
+
+	// 椅子ごと・バケットごとの売上を1クエリで集計する。売上の無い椅子も0円として返す
+	rows := []chairSalesRow{}
+	if err := h.db.SelectContext(ctx, &rows, `
+		SELECT
+			chairs.id AS chair_id,
+			chairs.name AS chair_name,
+			chairs.model,
+			CAST(`+bucketExpr+` AS DATETIME) AS bucket,
+			IFNULL(SUM(rides.fare), 0) AS sales
+		FROM chairs
+		LEFT JOIN (rides JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED')
+			ON rides.chair_id = chairs.id AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		WHERE chairs.owner_id = ?
+		GROUP BY chairs.id, bucket
+		ORDER BY chairs.id, bucket
+	`, since, until, owner.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	res := ownerGetSalesResponse{
-		TotalSales: 0,
+		TotalSales:  0,
+		Granularity: granularity,
 	}
 
-	modelSalesByModel := map[string]int{}
-	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.tx1.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	modelSalesByModel := map[string]*modelSales{}
+	modelBuckets := map[string]map[int64]int{}
+	totalBuckets := map[int64]int{}
+	for _, row := range rows {
+		if len(res.Chairs) == 0 || res.Chairs[len(res.Chairs)-1].ID != row.ChairID {
+			res.Chairs = append(res.Chairs, chairSales{
+				ID:   row.ChairID,
+				Name: row.ChairName,
+			})
 		}
+		chair := &res.Chairs[len(res.Chairs)-1]
+		chair.Sales += row.Sales
+		res.TotalSales += row.Sales
 
-		sales := sumSales(rides)
-		res.TotalSales += sales
-
-		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
-		})
+		if _, ok := modelSalesByModel[row.Model]; !ok {
+			modelSalesByModel[row.Model] = &modelSales{Model: row.Model}
+			modelBuckets[row.Model] = map[int64]int{}
+		}
+		modelSalesByModel[row.Model].Sales += row.Sales
 
-		modelSalesByModel[chair.Model] += sales
+		if row.Bucket.Valid {
+			start := row.Bucket.Time.UnixMilli()
+			chair.Buckets = append(chair.Buckets, salesBucket{Start: start, Sales: row.Sales})
+			modelBuckets[row.Model][start] += row.Sales
+			totalBuckets[start] += row.Sales
+		}
 	}
 
 	models := []modelSales{}
 	for model, sales := range modelSalesByModel {
-		models = append(models, modelSales{
-			Model: model,
-			Sales: sales,
-		})
+		sales.Buckets = sortedSalesBuckets(modelBuckets[model])
+		models = append(models, *sales)
 	}
+	slices.SortFunc(models, func(a, b modelSales) int {
+		return cmp.Compare(a.Model, b.Model)
+	})
 	res.Models = models
+	res.Buckets = sortedSalesBuckets(totalBuckets)
 
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
+func sortedSalesBuckets(salesByStart map[int64]int) []salesBucket {
+	buckets := make([]salesBucket, 0, len(salesByStart))
+	for start, sales := range salesByStart {
+		buckets = append(buckets, salesBucket{Start: start, Sales: sales})
 	}
-	return sale
-}
-
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-}
-
-type chairWithDetail struct {
-	ID                     string       `db:"id"`
-	OwnerID                string       `db:"owner_id"`
-	Name                   string       `db:"name"`
-	AccessToken            string       `db:"access_token"`
-	Model                  string       `db:"model"`
-	IsActive               bool         `db:"is_active"`
-	CreatedAt              time.Time    `db:"created_at"`
-	UpdatedAt              time.Time    `db:"updated_at"`
-	TotalDistance          int          `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	slices.SortFunc(buckets, func(a, b salesBucket) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return buckets
 }
 
 type ownerGetChairResponse struct {
@@ -191,6 +234,7 @@ type ownerGetChairResponseChair struct {
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
 }
 
 func (h *apiHandler) ownerGetChairs(w http.ResponseWriter, r *http.Request) {
@@ -203,114 +247,566 @@ func (h *apiHandler) ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chairIDs := make([]string, 0, len(chairs))
+	// 総移動距離は位置の受信時に chairs へ足し込んでいる
+	slices.SortStableFunc(chairs, func(i, j Chair) int {
+		return cmp.Compare(i.ID, j.ID)
+	})
+
+	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
-		chairIDs = append(chairIDs, chair.ID)
+		c := ownerGetChairResponseChair{
+			ID:            chair.ID,
+			Name:          chair.Name,
+			Model:         chair.Model,
+			Active:        chair.IsActive,
+			RegisteredAt:  chair.CreatedAt.UnixMilli(),
+			TotalDistance: chair.TotalDistance,
+		}
+		if chair.TotalDistanceUpdatedAt.Valid {
+			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
+			c.TotalDistanceUpdatedAt = &t
+		}
+		if chair.RetiredAt.Valid {
+			t := chair.RetiredAt.Time.UnixMilli()
+			c.RetiredAt = &t
+		}
+		res.Chairs = append(res.Chairs, c)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// オーナー自身の椅子を取得する。他のオーナーの椅子は存在しないものとして扱う
+func (h *apiHandler) getOwnedChair(ctx context.Context, owner *Owner, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := h.db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ?", chairID, owner.ID); err != nil {
+		return nil, err
 	}
+	return chair, nil
+}
 
-	chairMap := make(map[string]Chair, len(chairs))
-	for _, chair := range chairs {
-		chairMap[chair.ID] = chair
+func (h *apiHandler) writeOwnedChairError(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
 	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+type ownerPatchChairRequest struct {
+	Name string `json:"name"`
+}
+
+func (h *apiHandler) ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
 
-	query, args, err := sqlx.In("SELECT * FROM chair_locations WHERE chair_id IN (?) ORDER BY created_at ASC", chairIDs)
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
+		return
+	}
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
 	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
+	if chair.RetiredAt.Valid {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	if _, err := h.db.ExecContext(ctx, "UPDATE chairs SET name = ? WHERE id = ?", req.Name, chair.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chairAccessTokenCache.Forget(chair.AccessToken)
+	chair.Name = req.Name
+	h.chairGrid.setChair(*chair)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 椅子を受付停止にする。オーナーが解除するまで椅子側からは再開できない
+func (h *apiHandler) ownerPostChairDeactivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
+	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
 
-	chairLocations := []ChairLocation{}
-	if err := h.db.SelectContext(ctx, &chairLocations, query, args...); err != nil {
+	if _, err := h.db.ExecContext(
+		ctx,
+		"UPDATE chairs SET is_active = FALSE, deactivated_by_owner_at = IFNULL(deactivated_by_owner_at, CURRENT_TIMESTAMP(6)) WHERE id = ?",
+		chair.ID,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chairAccessTokenCache.Forget(chair.AccessToken)
+	h.chairGrid.setActive(chair.ID, false)
 
-	chairLocationsMap := make(map[string][]ChairLocation, len(chairLocations))
-	for _, chair := range chairs {
-		chairLocationsMap[chair.ID] = []ChairLocation{}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// オーナーによる受付停止を解除する。受付を再開するかどうかは椅子側に任せるので、稼働状態は変えない
+func (h *apiHandler) ownerPostChairActivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
+	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
+	if chair.RetiredAt.Valid {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	if _, err := h.db.ExecContext(ctx, "UPDATE chairs SET deactivated_by_owner_at = NULL WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairAccessTokenCache.Forget(chair.AccessToken)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 椅子を引退させる。以降はマッチング・付近の椅子・認証のいずれからも外れ、元に戻せない
+func (h *apiHandler) ownerPostChairRetire(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
+	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
+	if chair.RetiredAt.Valid {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 走行中のライドがある椅子は引退させない。相乗り中は先に終わったライドの方が新しいので、相手のライドも見る
+	var locked string
+	if err := tx.GetContext(ctx, &locked, "SELECT id FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := h.chairActiveRideStatus(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != nil {
+		writeError(w, http.StatusConflict, errors.New("chair has an ongoing ride"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE, retired_at = CURRENT_TIMESTAMP(6) WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairAccessTokenCache.Forget(chair.AccessToken)
+	h.chairGrid.remove(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostChairAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// 椅子のアクセストークンを再発行する。古いトークンはすぐに使えなくなる
+func (h *apiHandler) ownerPostChairAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
+	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
+	if chair.RetiredAt.Valid {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	accessToken := secureRandomStr(32)
+	if _, err := h.db.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", accessToken, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	for _, chairLocation := range chairLocations {
-		if _, ok := chairLocationsMap[chairLocation.ChairID]; !ok {
-			chairLocationsMap[chairLocation.ChairID] = []ChairLocation{}
+	chairAccessTokenCache.Forget(chair.AccessToken)
+
+	writeJSON(w, http.StatusOK, &ownerPostChairAccessTokenResponse{
+		AccessToken: accessToken,
+	})
+}
+
+type ownerPostChairRegisterTokenResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+// オーナーの無期限の椅子登録トークンを作り直す。古いトークンはすぐに使えなくなる
+func (h *apiHandler) ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairRegisterToken := secureRandomStr(32)
+	if _, err := h.db2.ExecContext(ctx, "UPDATE owners SET chair_register_token = ? WHERE id = ?", chairRegisterToken, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerPostChairRegisterTokenResponse{
+		ChairRegisterToken: chairRegisterToken,
+	})
+}
+
+type ownerPostChairRegisterTokensRequest struct {
+	Model     *string `json:"model"`
+	MaxChairs *int    `json:"max_chairs"`
+	ExpiresAt *int64  `json:"expires_at"`
+}
+
+type ownerChairRegisterToken struct {
+	ChairRegisterToken string  `json:"chair_register_token"`
+	Model              *string `json:"model"`
+	MaxChairs          *int    `json:"max_chairs"`
+	RegisteredChairs   int     `json:"registered_chairs"`
+	ExpiresAt          *int64  `json:"expires_at"`
+	CreatedAt          int64   `json:"created_at"`
+}
+
+func newOwnerChairRegisterToken(token *ChairRegisterToken) ownerChairRegisterToken {
+	res := ownerChairRegisterToken{
+		ChairRegisterToken: token.Token,
+		Model:              token.Model,
+		MaxChairs:          token.MaxChairs,
+		RegisteredChairs:   token.RegisteredChairs,
+		CreatedAt:          token.CreatedAt.UnixMilli(),
+	}
+	if token.ExpiresAt.Valid {
+		t := token.ExpiresAt.Time.UnixMilli()
+		res.ExpiresAt = &t
+	}
+	return res
+}
+
+// 有効期限・台数・モデルを制限した椅子登録トークンを追加で発行する
+func (h *apiHandler) ownerPostChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostChairRegisterTokensRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.MaxChairs != nil && *req.MaxChairs < 1 {
+		writeError(w, http.StatusBadRequest, errors.New("max_chairs must be positive"))
+		return
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: time.UnixMilli(*req.ExpiresAt), Valid: true}
+		if expiresAt.Time.Before(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
 		}
-		chairLocationsMap[chairLocation.ChairID] = append(chairLocationsMap[chairLocation.ChairID], chairLocation)
+	}
+	if req.Model != nil && *req.Model == "" {
+		req.Model = nil
 	}
 
-	chairDetails := make([]chairWithDetail, 0, len(chairLocationsMap))
-	for chairID, locations := range chairLocationsMap {
+	token := secureRandomStr(32)
+	if _, err := h.db2.ExecContext(
+		ctx,
+		"INSERT INTO chair_register_tokens (token, owner_id, model, max_chairs, expires_at) VALUES (?, ?, ?, ?, ?)",
+		token, owner.ID, req.Model, req.MaxChairs, expiresAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	registerToken := &ChairRegisterToken{}
+	if err := h.db2.GetContext(ctx, registerToken, "SELECT * FROM chair_register_tokens WHERE token = ?", token); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerChairRegisterToken(registerToken))
+}
+
+type ownerGetChairRegisterTokensResponse struct {
+	Tokens []ownerChairRegisterToken `json:"tokens"`
+}
+
+func (h *apiHandler) ownerGetChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	tokens := []ChairRegisterToken{}
+	if err := h.db2.SelectContext(ctx, &tokens, "SELECT * FROM chair_register_tokens WHERE owner_id = ? ORDER BY created_at DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairRegisterTokensResponse{
+		Tokens: make([]ownerChairRegisterToken, 0, len(tokens)),
+	}
+	for _, token := range tokens {
+		res.Tokens = append(res.Tokens, newOwnerChairRegisterToken(&token))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *apiHandler) ownerDeleteChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	result, err := h.db2.ExecContext(ctx, "DELETE FROM chair_register_tokens WHERE token = ? AND owner_id = ?", r.PathValue("token"), owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("chair_register_token not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerGetChairDetailResponse struct {
+	ID                  string                               `json:"id"`
+	Name                string                               `json:"name"`
+	Model               string                               `json:"model"`
+	Active              bool                                 `json:"active"`
+	RegisteredAt        int64                                `json:"registered_at"`
+	RetiredAt           *int64                               `json:"retired_at,omitempty"`
+	OutOfServiceArea    bool                                 `json:"out_of_service_area"`
+	Stats               appGetNotificationResponseChairStats `json:"stats"`
+	ActiveTimeMs        int64                                `json:"active_time_ms"`
+	IdleTimeMs          int64                                `json:"idle_time_ms"`
+	Rides               []ownerGetChairDetailResponseRide    `json:"rides"`
+	Locations           []ownerGetChairDetailLocation        `json:"locations"`
+	NextLocationsCursor string                               `json:"next_locations_cursor,omitempty"`
+}
 
-		distance := 0
-		for i := 1; i < len(locations); i++ {
-			distance += abs(locations[i].Latitude-locations[i-1].Latitude) + abs(locations[i].Longitude-locations[i-1].Longitude)
+type ownerGetChairDetailResponseRide struct {
+	ID                    string     `json:"id"`
+	Status                string     `json:"status"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Fare                  int        `json:"fare"`
+	Evaluation            *int       `json:"evaluation"`
+	RequestedAt           int64      `json:"requested_at"`
+	UpdatedAt             int64      `json:"updated_at"`
+}
+
+type ownerGetChairDetailLocation struct {
+	ID         string     `json:"id"`
+	Coordinate Coordinate `json:"coordinate"`
+	RecordedAt int64      `json:"recorded_at"`
+}
+
+type chairRideStatusTime struct {
+	RideID    string    `db:"ride_id"`
+	Status    string    `db:"status"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// 苦情調査などのために、1台の椅子の最近のライドと位置履歴をまとめて返す
+func (h *apiHandler) ownerGetChairDetail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	ridesLimit := 20
+	if v := r.URL.Query().Get("rides_limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("rides_limit must be between 1 and 100"))
+			return
 		}
-		var updatedAt sql.NullTime
-		if len(locations) != 0 {
-			updatedAt = sql.NullTime{
-				Time:  locations[len(locations)-1].CreatedAt,
-				Valid: true,
-			}
+		ridesLimit = parsed
+	}
+	locationsLimit := 100
+	if v := r.URL.Query().Get("locations_limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			writeError(w, http.StatusBadRequest, errors.New("locations_limit must be between 1 and 1000"))
+			return
 		}
+		locationsLimit = parsed
+	}
+	locationsCursor := r.URL.Query().Get("locations_cursor")
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
+	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	stats, err := getChairStats(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairDetailResponse{
+		ID:               chair.ID,
+		Name:             chair.Name,
+		Model:            chair.Model,
+		Active:           chair.IsActive,
+		RegisteredAt:     chair.CreatedAt.UnixMilli(),
+		Stats:            stats,
+		OutOfServiceArea: h.serviceArea.chairOutOfArea(chair.ID),
+		Rides:            []ownerGetChairDetailResponseRide{},
+		Locations:        []ownerGetChairDetailLocation{},
+	}
+	if chair.RetiredAt.Valid {
+		t := chair.RetiredAt.Time.UnixMilli()
+		res.RetiredAt = &t
+	}
 
-		chairDetails = append(chairDetails, chairWithDetail{
-			ID:                     chairID,
-			OwnerID:                chairMap[chairID].OwnerID,
-			Name:                   chairMap[chairID].Name,
-			AccessToken:            chairMap[chairID].AccessToken,
-			Model:                  chairMap[chairID].Model,
-			IsActive:               chairMap[chairID].IsActive,
-			CreatedAt:              chairMap[chairID].CreatedAt,
-			UpdatedAt:              chairMap[chairID].UpdatedAt,
-			TotalDistance:          distance,
-			TotalDistanceUpdatedAt: updatedAt,
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE chair_id = ? ORDER BY created_at DESC LIMIT ?", chair.ID, ridesLimit); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, ride := range rides {
+		status, err := h.getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		res.Rides = append(res.Rides, ownerGetChairDetailResponseRide{
+			ID:                    ride.ID,
+			Status:                status,
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			Fare:                  ride.Fare,
+			Evaluation:            ride.Evaluation,
+			RequestedAt:           ride.CreatedAt.UnixMilli(),
+			UpdatedAt:             ride.UpdatedAt.UnixMilli(),
 		})
 	}
 
-	// 	chairLocations := []chairWithDetail{}
-	// 	if err := h.db.SelectContext(ctx, &chairLocations, `SELECT id,
-	//        owner_id,
-	//        name,
-	//        access_token,
-	//        model,
-	//        is_active,
-	//        created_at,
-	//        updated_at,
-	//        IFNULL(total_distance, 0) AS total_distance,
-	//        total_distance_updated_at
-	// FROM chairs
-	//        LEFT JOIN (SELECT chair_id,
-	//                           SUM(IFNULL(distance, 0)) AS total_distance,
-	//                           MAX(created_at)          AS total_distance_updated_at
-	//                    FROM (SELECT chair_id,
-	//                                 created_at,
-	//                                 ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
-	//                                 ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
-	//                          FROM chair_locations) tmp
-	//                    GROUP BY chair_id) distance_table ON distance_table.chair_id = chairs.id
-	// WHERE owner_id = ?
-	// `, owner.ID); err != nil {
-	// 		writeError(w, http.StatusInternalServerError, err)
-	// 		return
-	// 	}
-
-	slices.SortStableFunc(chairDetails, func(i, j chairWithDetail) int {
-		return cmp.Compare(i.ID, j.ID)
-	})
+	// 位置履歴は新しい順。カーソルは前のページの最後の位置ID
+	locations := []ChairLocation{}
+	if locationsCursor == "" {
+		err = tx.SelectContext(ctx, &locations,
+			"SELECT * FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC, id DESC LIMIT ?",
+			chair.ID, locationsLimit+1)
+	} else {
+		// 知らない位置やほかの椅子の位置をカーソルに渡されたら、空のページではなくエラーにする
+		cursor := ChairLocation{}
+		if err := tx.GetContext(ctx, &cursor, "SELECT * FROM chair_locations WHERE id = ? AND chair_id = ?", locationsCursor, chair.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusBadRequest, errors.New("invalid cursor"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		err = tx.SelectContext(ctx, &locations,
+			`SELECT * FROM chair_locations
+			 WHERE chair_id = ? AND (created_at, id) < (?, ?)
+			 ORDER BY created_at DESC, id DESC LIMIT ?`,
+			chair.ID, cursor.CreatedAt, cursor.ID, locationsLimit+1)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(locations) > locationsLimit {
+		locations = locations[:locationsLimit]
+		res.NextLocationsCursor = locations[len(locations)-1].ID
+	}
+	for _, location := range locations {
+		res.Locations = append(res.Locations, ownerGetChairDetailLocation{
+			ID:         location.ID,
+			Coordinate: Coordinate{Latitude: location.Latitude, Longitude: location.Longitude},
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		})
+	}
 
-	res := ownerGetChairResponse{}
-	for _, chair := range chairDetails {
-		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: chair.TotalDistance,
+	// 稼働時間は ENROUTE から ARRIVED まで(走行中なら現在まで)、
+	// 待機時間は最初と最後の位置送信の間のうち稼働していなかった時間とする
+	statusTimes := []chairRideStatusTime{}
+	if err := tx.SelectContext(ctx, &statusTimes,
+		`SELECT ride_statuses.ride_id, ride_statuses.status, ride_statuses.created_at
+		 FROM ride_statuses JOIN rides ON rides.id = ride_statuses.ride_id
+		 WHERE rides.chair_id = ? AND ride_statuses.status IN ('ENROUTE', 'ARRIVED')`,
+		chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	enrouteAt := map[string]time.Time{}
+	arrivedAt := map[string]time.Time{}
+	for _, st := range statusTimes {
+		if st.Status == "ENROUTE" {
+			enrouteAt[st.RideID] = st.CreatedAt
+		} else {
+			arrivedAt[st.RideID] = st.CreatedAt
 		}
-		if chair.TotalDistanceUpdatedAt.Valid {
-			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
-			c.TotalDistanceUpdatedAt = &t
+	}
+	var activeTime time.Duration
+	for rideID, start := range enrouteAt {
+		end, ok := arrivedAt[rideID]
+		if !ok {
+			end = now
 		}
-		res.Chairs = append(res.Chairs, c)
+		activeTime += end.Sub(start)
 	}
+	res.ActiveTimeMs = activeTime.Milliseconds()
+
+	var firstLocationAt, lastLocationAt sql.NullTime
+	if err := tx.QueryRowContext(ctx, "SELECT MIN(created_at), MAX(created_at) FROM chair_locations WHERE chair_id = ?", chair.ID).Scan(&firstLocationAt, &lastLocationAt); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if firstLocationAt.Valid {
+		res.IdleTimeMs = max(lastLocationAt.Time.Sub(firstLocationAt.Time)-activeTime, 0).Milliseconds()
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	writeJSON(w, http.StatusOK, res)
 }
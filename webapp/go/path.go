@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 1回に返す位置の最大数。これを超えた新しい位置は返さない
+const maxPathPoints = 10000
+
+type pathPoint struct {
+	Latitude   int   `json:"latitude"`
+	Longitude  int   `json:"longitude"`
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+type chairPathResponse struct {
+	ChairID        string      `json:"chair_id"`
+	RideID         string      `json:"ride_id,omitempty"`
+	Points         []pathPoint `json:"points"`
+	OriginalPoints int         `json:"original_points"`
+	Simplified     bool        `json:"simplified"`
+	Truncated      bool        `json:"truncated"`
+}
+
+type pathOptions struct {
+	// 0 なら間引かない
+	Tolerance float64
+	GeoJSON   bool
+}
+
+// ?tolerance= と ?format= を読む
+func parsePathOptions(r *http.Request) (pathOptions, error) {
+	opts := pathOptions{}
+	if v := r.URL.Query().Get("tolerance"); v != "" {
+		tolerance, err := strconv.ParseFloat(v, 64)
+		if err != nil || tolerance < 0 || math.IsInf(tolerance, 0) || math.IsNaN(tolerance) {
+			return opts, errors.New("tolerance must be a non-negative number")
+		}
+		opts.Tolerance = tolerance
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "geojson":
+		opts.GeoJSON = true
+	default:
+		return opts, errors.New("format must be json or geojson")
+	}
+	return opts, nil
+}
+
+// 椅子の since から until まで(両端を含む)の位置を古い順に読む
+func (h *apiHandler) selectChairPath(ctx context.Context, chairID string, since, until time.Time) ([]ChairLocation, bool, error) {
+	locations := []ChairLocation{}
+	if err := h.db.SelectContext(
+		ctx,
+		&locations,
+		"SELECT * FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? ORDER BY created_at, id LIMIT ?",
+		chairID, since, until, maxPathPoints+1,
+	); err != nil {
+		return nil, false, err
+	}
+	if len(locations) > maxPathPoints {
+		return locations[:maxPathPoints], true, nil
+	}
+	return locations, false, nil
+}
+
+func writeChairPath(w http.ResponseWriter, res *chairPathResponse, locations []ChairLocation, opts pathOptions) {
+	points := make([]pathPoint, 0, len(locations))
+	for _, location := range locations {
+		points = append(points, pathPoint{
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		})
+	}
+	res.OriginalPoints = len(points)
+	if opts.Tolerance > 0 {
+		points = simplifyPath(points, opts.Tolerance)
+		res.Simplified = true
+	}
+	res.Points = points
+
+	if opts.GeoJSON {
+		buf, err := json.Marshal(newPathGeoJSON(res))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/geo+json;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Ramer-Douglas-Peucker 法で、線分からのずれが tolerance 以下の点を間引く。始点と終点は必ず残す
+func simplifyPath(points []pathPoint, tolerance float64) []pathPoint {
+	if len(points) < 3 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0] = true
+	keep[len(points)-1] = true
+
+	type span struct{ first, last int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		farthest, maxDistance := -1, 0.0
+		for i := s.first + 1; i < s.last; i++ {
+			if d := distanceToSegment(points[i], points[s.first], points[s.last]); d > maxDistance {
+				farthest, maxDistance = i, d
+			}
+		}
+		if farthest >= 0 && maxDistance > tolerance {
+			keep[farthest] = true
+			stack = append(stack, span{s.first, farthest}, span{farthest, s.last})
+		}
+	}
+
+	simplified := make([]pathPoint, 0, len(points))
+	for i, point := range points {
+		if keep[i] {
+			simplified = append(simplified, point)
+		}
+	}
+	return simplified
+}
+
+// 点 p から線分 ab までのユークリッド距離
+func distanceToSegment(p, a, b pathPoint) float64 {
+	px, py := float64(p.Longitude), float64(p.Latitude)
+	ax, ay := float64(a.Longitude), float64(a.Latitude)
+	bx, by := float64(b.Longitude), float64(b.Latitude)
+
+	dx, dy := bx-ax, by-ay
+	if dx == 0 && dy == 0 {
+		return math.Hypot(px-ax, py-ay)
+	}
+	t := ((px-ax)*dx + (py-ay)*dy) / (dx*dx + dy*dy)
+	t = max(0, min(1, t))
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+type pathGeoJSON struct {
+	Type       string                `json:"type"`
+	Geometry   pathGeoJSONGeometry   `json:"geometry"`
+	Properties pathGeoJSONProperties `json:"properties"`
+}
+
+type pathGeoJSONGeometry struct {
+	Type        string   `json:"type"`
+	Coordinates [][2]int `json:"coordinates"`
+}
+
+type pathGeoJSONProperties struct {
+	ChairID        string  `json:"chair_id"`
+	RideID         string  `json:"ride_id,omitempty"`
+	Times          []int64 `json:"times"`
+	OriginalPoints int     `json:"original_points"`
+	Simplified     bool    `json:"simplified"`
+	Truncated      bool    `json:"truncated"`
+}
+
+// GeoJSON の LineString の Feature にする。座標は GeoJSON の慣習どおり [経度, 緯度] の順
+func newPathGeoJSON(res *chairPathResponse) pathGeoJSON {
+	coordinates := make([][2]int, 0, len(res.Points))
+	times := make([]int64, 0, len(res.Points))
+	for _, point := range res.Points {
+		coordinates = append(coordinates, [2]int{point.Longitude, point.Latitude})
+		times = append(times, point.RecordedAt)
+	}
+	return pathGeoJSON{
+		Type: "Feature",
+		Geometry: pathGeoJSONGeometry{
+			Type:        "LineString",
+			Coordinates: coordinates,
+		},
+		Properties: pathGeoJSONProperties{
+			ChairID:        res.ChairID,
+			RideID:         res.RideID,
+			Times:          times,
+			OriginalPoints: res.OriginalPoints,
+			Simplified:     res.Simplified,
+			Truncated:      res.Truncated,
+		},
+	}
+}
+
+// 椅子の指定期間の移動経路。since/until は ownerGetSales と同じ
+func (h *apiHandler) ownerGetChairPath(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts, err := parsePathOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	chair, err := h.getOwnedChair(ctx, owner, r.PathValue("chair_id"))
+	if err != nil {
+		h.writeOwnedChairError(w, err)
+		return
+	}
+
+	locations, truncated, err := h.selectChairPath(ctx, chair.ID, since, until.Add(999*time.Microsecond))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeChairPath(w, &chairPathResponse{ChairID: chair.ID, Truncated: truncated}, locations, opts)
+}
+
+// ライドの乗車(PICKUP)から到着(ARRIVED)までの経路。到着前なら現在までを返す
+func (h *apiHandler) writeRidePath(w http.ResponseWriter, r *http.Request, ride *Ride) {
+	ctx := r.Context()
+
+	opts, err := parsePathOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !ride.ChairID.Valid {
+		writeError(w, http.StatusBadRequest, errors.New("ride has not been picked up yet"))
+		return
+	}
+
+	statuses := []RideStatus{}
+	if err := h.db.SelectContext(ctx, &statuses, "SELECT * FROM ride_statuses WHERE ride_id = ? AND status IN ('PICKUP', 'ARRIVED')", ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var pickupAt time.Time
+	until := time.Now()
+	for _, status := range statuses {
+		if status.Status == "PICKUP" {
+			pickupAt = status.CreatedAt
+		} else {
+			until = status.CreatedAt
+		}
+	}
+	if pickupAt.IsZero() {
+		writeError(w, http.StatusBadRequest, errors.New("ride has not been picked up yet"))
+		return
+	}
+
+	// PICKUP は乗車地の位置を記録した後に作られるので、その直前の位置から始める
+	since := pickupAt
+	var pickupLocationAt sql.NullTime
+	if err := h.db.GetContext(ctx, &pickupLocationAt, "SELECT MAX(created_at) FROM chair_locations WHERE chair_id = ? AND created_at <= ?", ride.ChairID.String, pickupAt); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if pickupLocationAt.Valid {
+		since = pickupLocationAt.Time
+	}
+
+	locations, truncated, err := h.selectChairPath(ctx, ride.ChairID.String, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeChairPath(w, &chairPathResponse{ChairID: ride.ChairID.String, RideID: ride.ID, Truncated: truncated}, locations, opts)
+}
+
+// オーナーの椅子が担当したライドの経路
+func (h *apiHandler) ownerGetRidePath(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	ride := &Ride{}
+	if err := h.db.GetContext(
+		ctx,
+		ride,
+		"SELECT rides.* FROM rides JOIN chairs ON chairs.id = rides.chair_id WHERE rides.id = ? AND chairs.owner_id = ?",
+		r.PathValue("ride_id"), owner.ID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeRidePath(w, r, ride)
+}
+
+// ユーザー自身のライドの経路
+func (h *apiHandler) appGetRidePath(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	ride := &Ride{}
+	if err := h.db.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? AND user_id = ?", r.PathValue("ride_id"), user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeRidePath(w, r, ride)
+}
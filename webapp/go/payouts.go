@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// settings に手数料率が無いときの手数料率(%)
+const defaultCommissionRate = 10
+
+// settings の platform_commission_rate から1ライドあたりの手数料率(%)を読む
+func getCommissionRate(ctx context.Context, tx executableGet) (int, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'platform_commission_rate'"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return defaultCommissionRate, nil
+		}
+		return 0, err
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil || rate < 0 || rate > 100 {
+		return 0, errors.New("platform_commission_rate must be an integer between 0 and 100")
+	}
+	return rate, nil
+}
+
+type chairEarningsRow struct {
+	ChairID    string `db:"chair_id"`
+	ChairName  string `db:"chair_name"`
+	Rides      int    `db:"rides"`
+	Gross      int    `db:"gross"`
+	Commission int    `db:"commission"`
+}
+
+// (since, until] に完了したライドの売上と手数料を椅子ごとに集計する。完了時刻は COMPLETED の ride_statuses.created_at で、
+// rides.updated_at は完了後の更新でも変わるので、支払い済みの期間のライドをもう一度数えないよう使わない。
+// 手数料はライドごとに切り捨てるので、合計に手数料率を掛けた値とは一致しないことがある
+func selectChairEarnings(ctx context.Context, tx sqlx.QueryerContext, ownerID string, since, until time.Time, commissionRate int) ([]chairEarningsRow, error) {
+	rows := []chairEarningsRow{}
+	err := sqlx.SelectContext(ctx, tx, &rows, `
+		SELECT
+			chairs.id AS chair_id,
+			chairs.name AS chair_name,
+			COUNT(rides.id) AS rides,
+			IFNULL(SUM(rides.fare), 0) AS gross,
+			IFNULL(SUM(FLOOR(rides.fare * ? / 100)), 0) AS commission
+		FROM chairs
+		LEFT JOIN (rides JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED')
+			ON rides.chair_id = chairs.id AND ride_statuses.created_at > ? AND ride_statuses.created_at <= ?
+		WHERE chairs.owner_id = ?
+		GROUP BY chairs.id
+		ORDER BY chairs.id
+	`, commissionRate, since, until, ownerID)
+	return rows, err
+}
+
+type ownerGetEarningsResponse struct {
+	CommissionRate  int                             `json:"commission_rate"`
+	TotalGross      int                             `json:"total_gross"`
+	TotalCommission int                             `json:"total_commission"`
+	TotalNet        int                             `json:"total_net"`
+	Chairs          []ownerGetEarningsResponseChair `json:"chairs"`
+}
+
+type ownerGetEarningsResponseChair struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Rides      int    `json:"rides"`
+	Gross      int    `json:"gross"`
+	Commission int    `json:"commission"`
+	Net        int    `json:"net"`
+}
+
+// 期間内の椅子ごとの純収益。since/until は ownerGetSales と同じ
+func (h *apiHandler) ownerGetEarnings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+
+	commissionRate, err := getCommissionRate(ctx, h.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// ownerGetSales は since と until のミリ秒を両端とも含むので、それに合わせる
+	rows, err := selectChairEarnings(ctx, h.db, owner.ID, since.Add(-time.Microsecond), until.Add(999*time.Microsecond), commissionRate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetEarningsResponse{
+		CommissionRate: commissionRate,
+		Chairs:         []ownerGetEarningsResponseChair{},
+	}
+	for _, row := range rows {
+		res.Chairs = append(res.Chairs, ownerGetEarningsResponseChair{
+			ID:         row.ChairID,
+			Name:       row.ChairName,
+			Rides:      row.Rides,
+			Gross:      row.Gross,
+			Commission: row.Commission,
+			Net:        row.Gross - row.Commission,
+		})
+		res.TotalGross += row.Gross
+		res.TotalCommission += row.Commission
+		res.TotalNet += row.Gross - row.Commission
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPayoutStatement struct {
+	ID             string                      `json:"id"`
+	PeriodSince    int64                       `json:"period_since"`
+	PeriodUntil    int64                       `json:"period_until"`
+	CommissionRate int                         `json:"commission_rate"`
+	Rides          int                         `json:"rides"`
+	Gross          int                         `json:"gross"`
+	Commission     int                         `json:"commission"`
+	Net            int                         `json:"net"`
+	Status         string                      `json:"status"`
+	PaidAt         *int64                      `json:"paid_at,omitempty"`
+	CreatedAt      int64                       `json:"created_at"`
+	Chairs         []ownerPayoutStatementChair `json:"chairs"`
+}
+
+type ownerPayoutStatementChair struct {
+	ID         string `json:"id"`
+	Rides      int    `json:"rides"`
+	Gross      int    `json:"gross"`
+	Commission int    `json:"commission"`
+	Net        int    `json:"net"`
+}
+
+func newOwnerPayoutStatement(statement PayoutStatement, chairs []PayoutStatementChair) ownerPayoutStatement {
+	res := ownerPayoutStatement{
+		ID:             statement.ID,
+		PeriodSince:    statement.PeriodSince.UnixMilli(),
+		PeriodUntil:    statement.PeriodUntil.UnixMilli(),
+		CommissionRate: statement.CommissionRate,
+		Rides:          statement.Rides,
+		Gross:          statement.Gross,
+		Commission:     statement.Commission,
+		Net:            statement.Net,
+		Status:         statement.Status,
+		CreatedAt:      statement.CreatedAt.UnixMilli(),
+		Chairs:         []ownerPayoutStatementChair{},
+	}
+	if statement.PaidAt.Valid {
+		t := statement.PaidAt.Time.UnixMilli()
+		res.PaidAt = &t
+	}
+	for _, chair := range chairs {
+		res.Chairs = append(res.Chairs, ownerPayoutStatementChair{
+			ID:         chair.ChairID,
+			Rides:      chair.Rides,
+			Gross:      chair.Gross,
+			Commission: chair.Commission,
+			Net:        chair.Net,
+		})
+	}
+	return res
+}
+
+var errConcurrentPayout = errors.New("another payout statement is being created")
+
+// 同じオーナーの明細を同時に作ると、前回の明細が無いときはロックする行が無いので両方とも同じ期間で INSERT しようとする。
+// 負けた方は UNIQUE (owner_id, period_since) に当たるか、ギャップロックでデッドロックになる
+func isConcurrentPayoutError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1062 || mysqlErr.Number == 1213)
+}
+
+type ownerPostPayoutRequest struct {
+	// 省略時は現在時刻まで
+	Until *int64 `json:"until"`
+}
+
+// 前回の明細の終わりから until までに完了したライドの支払い明細を作る。
+// 期間が重ならないので、同じライドが2回支払われることはない
+func (h *apiHandler) ownerPostPayout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &ownerPostPayoutRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+
+	now := time.Now().Truncate(time.Microsecond)
+	until := now
+	if req.Until != nil {
+		until = time.UnixMilli(*req.Until)
+		// 未来まで締めると、後から完了したライドが明細から漏れる
+		if until.After(now) {
+			writeError(w, http.StatusBadRequest, errors.New("until must not be in the future"))
+			return
+		}
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	since := time.Unix(0, 0)
+	var lastUntil time.Time
+	if err := tx.GetContext(ctx, &lastUntil, "SELECT period_until FROM payout_statements WHERE owner_id = ? ORDER BY period_until DESC LIMIT 1 FOR UPDATE", owner.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		since = lastUntil
+	}
+	if !until.After(since) {
+		writeError(w, http.StatusBadRequest, errors.New("until must be after the end of the previous statement"))
+		return
+	}
+
+	commissionRate, err := getCommissionRate(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rows, err := selectChairEarnings(ctx, tx, owner.ID, since, until, commissionRate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statement := PayoutStatement{
+		ID:             ulid.Make().String(),
+		OwnerID:        owner.ID,
+		PeriodSince:    since,
+		PeriodUntil:    until,
+		CommissionRate: commissionRate,
+		Status:         "UNPAID",
+		CreatedAt:      now,
+	}
+	chairs := []PayoutStatementChair{}
+	for _, row := range rows {
+		if row.Rides == 0 {
+			continue
+		}
+		chairs = append(chairs, PayoutStatementChair{
+			StatementID: statement.ID,
+			ChairID:     row.ChairID,
+			Rides:       row.Rides,
+			Gross:       row.Gross,
+			Commission:  row.Commission,
+			Net:         row.Gross - row.Commission,
+		})
+		statement.Rides += row.Rides
+		statement.Gross += row.Gross
+		statement.Commission += row.Commission
+		statement.Net += row.Gross - row.Commission
+	}
+
+	if _, err := tx.NamedExecContext(ctx, `
+		INSERT INTO payout_statements (id, owner_id, period_since, period_until, commission_rate, rides, gross, commission, net, status, created_at)
+		VALUES (:id, :owner_id, :period_since, :period_until, :commission_rate, :rides, :gross, :commission, :net, :status, :created_at)
+	`, statement); err != nil {
+		if isConcurrentPayoutError(err) {
+			writeError(w, http.StatusConflict, errConcurrentPayout)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(chairs) > 0 {
+		if _, err := tx.NamedExecContext(ctx, `
+			INSERT INTO payout_statement_chairs (statement_id, chair_id, rides, gross, commission, net)
+			VALUES (:statement_id, :chair_id, :rides, :gross, :commission, :net)
+		`, chairs); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		if isConcurrentPayoutError(err) {
+			writeError(w, http.StatusConflict, errConcurrentPayout)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerPayoutStatement(statement, chairs))
+}
+
+type ownerGetPayoutsResponse struct {
+	Statements []ownerPayoutStatement `json:"statements"`
+}
+
+// 支払い明細を新しい順に返す
+func (h *apiHandler) ownerGetPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	statements := []PayoutStatement{}
+	if err := h.db.SelectContext(ctx, &statements, "SELECT * FROM payout_statements WHERE owner_id = ? ORDER BY period_until DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetPayoutsResponse{Statements: []ownerPayoutStatement{}}
+	if len(statements) == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	statementIDs := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		statementIDs = append(statementIDs, statement.ID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM payout_statement_chairs WHERE statement_id IN (?) ORDER BY chair_id", statementIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairs := []PayoutStatementChair{}
+	if err := h.db.SelectContext(ctx, &chairs, query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairsByStatementID := map[string][]PayoutStatementChair{}
+	for _, chair := range chairs {
+		chairsByStatementID[chair.StatementID] = append(chairsByStatementID[chair.StatementID], chair)
+	}
+
+	for _, statement := range statements {
+		res.Statements = append(res.Statements, newOwnerPayoutStatement(statement, chairsByStatementID[statement.ID]))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 支払い明細を支払い済みにする。実際に振り込むのは運営なので、オーナーからは呼べない内部APIにしている
+func (h *apiHandler) internalPostPayoutPaid(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	payoutID := r.PathValue("payout_id")
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	statement := PayoutStatement{}
+	if err := tx.GetContext(ctx, &statement, "SELECT * FROM payout_statements WHERE id = ? FOR UPDATE", payoutID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payout statement not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if statement.Status == "PAID" {
+		writeError(w, http.StatusConflict, errors.New("payout statement is already paid"))
+		return
+	}
+
+	paidAt := time.Now().Truncate(time.Microsecond)
+	if _, err := tx.ExecContext(ctx, "UPDATE payout_statements SET status = 'PAID', paid_at = ? WHERE id = ?", paidAt, statement.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairs := []PayoutStatementChair{}
+	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM payout_statement_chairs WHERE statement_id = ? ORDER BY chair_id", statement.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statement.Status = "PAID"
+	statement.PaidAt = sql.NullTime{Time: paidAt, Valid: true}
+	writeJSON(w, http.StatusOK, newOwnerPayoutStatement(statement, chairs))
+}
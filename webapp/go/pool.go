@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var errPooledRideWithWaypoints = errors.New("pooled rides cannot have waypoints")
+
+type poolConfig struct {
+	// 先に乗っている利用者と後から乗る利用者、それぞれに許す遠回りの距離
+	MaxDetour int
+	// 相乗りを選んだライドの距離ぶんの運賃から割り引く割合(%)
+	DiscountPercent int
+}
+
+func newPoolConfigFromEnv() poolConfig {
+	config := poolConfig{
+		MaxDetour:       20,
+		DiscountPercent: 20,
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_POOL_MAX_DETOUR")); err == nil && v >= 0 {
+		config.MaxDetour = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_POOL_DISCOUNT_PERCENT")); err == nil && v >= 0 && v <= 100 {
+		config.DiscountPercent = v
+	}
+	return config
+}
+
+// 相乗りの割引率(%)。サージと同じく距離ぶんの運賃にだけ掛け、クーポンはその残りに適用する
+func (c poolConfig) discountPercent(pooled bool) int {
+	if !pooled {
+		return 0
+	}
+	return c.DiscountPercent
+}
+
+// 椅子は今の位置から後の利用者の乗車地に寄り、先に乗っている利用者の目的地、後の利用者の目的地の順に回る。
+// それぞれが1人で乗った場合より余計に進む距離を返す
+func poolDetours(current, hostDestination, pickup, destination Coordinate) (hostDetour, guestDetour int) {
+	distance := func(a, b Coordinate) int {
+		return calculateDistance(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
+	}
+	hostDetour = distance(current, pickup) + distance(pickup, hostDestination) - distance(current, hostDestination)
+	guestDetour = distance(pickup, hostDestination) + distance(hostDestination, destination) - distance(pickup, destination)
+	return hostDetour, guestDetour
+}
+
+// 相乗りを受け付けている椅子のうち、遠回りが上限以内で最も少ないものに ride を乗せる。乗せられなければ false
+func (h *apiHandler) matchPooledRide(ctx context.Context, ride *Ride) (bool, error) {
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+
+	var best *chairGridState
+	bestDetour := 0
+	for _, chair := range h.chairGrid.poolChairs() {
+		hostDetour, guestDetour := poolDetours(*chair.Location, chair.PoolRide.Destination, pickup, destination)
+		if hostDetour > h.pool.MaxDetour || guestDetour > h.pool.MaxDetour {
+			continue
+		}
+		if best == nil || hostDetour+guestDetour < bestDetour {
+			best = &chair
+			bestDetour = hostDetour + guestDetour
+		}
+	}
+	if best == nil {
+		return false, nil
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	host := &Ride{}
+	if err := tx.GetContext(ctx, host, "SELECT * FROM rides WHERE id = ? FOR UPDATE", best.PoolRide.RideID); err != nil {
+		return false, err
+	}
+	status, err := h.getLatestRideStatus(ctx, tx, host.ID)
+	if err != nil {
+		return false, err
+	}
+	if host.ChairID.String != best.ID || host.PooledWith.Valid || status != "CARRYING" {
+		// 乗せている間に状態が変わっていた
+		h.chairGrid.closePoolRide(best.ID, host.ID)
+		return false, nil
+	}
+
+	price, err := h.priceRideForModel(ctx, tx, ride, best.Model)
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE rides SET chair_id = ?, pooled_with = ?, fare = ?, discount = ?, pool_discount = ?, initial_fare = ?, fare_per_distance = ? WHERE id = ? AND chair_id IS NULL",
+		best.ID, host.ID, price.Fare, price.Discount, price.PoolDiscount, price.Rate.InitialFare, price.Rate.FarePerDistance, ride.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if count == 0 {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE rides SET pooled_with = ? WHERE id = ?", ride.ID, host.ID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	h.chairGrid.closePoolRide(best.ID, host.ID)
+	return true, nil
+}
+
+// 相乗りを選んで乗車中で、まだ相手が決まっていないライドを椅子ごとに返す
+func (h *apiHandler) openPoolRides(ctx context.Context) (map[string]chairGridPoolRide, error) {
+	rides := []Ride{}
+	if err := h.db.SelectContext(ctx, &rides, `
+		SELECT * FROM rides
+		WHERE pooled = TRUE
+		  AND pooled_with IS NULL
+		  AND chair_id IS NOT NULL
+		  AND EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'CARRYING')
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'ARRIVED')
+	`); err != nil {
+		return nil, err
+	}
+	poolRides := make(map[string]chairGridPoolRide, len(rides))
+	for _, ride := range rides {
+		poolRides[ride.ChairID.String] = chairGridPoolRide{
+			RideID:      ride.ID,
+			Destination: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		}
+	}
+	return poolRides, nil
+}
+
+// 椅子に割り当てられている最新のライドと、相乗りしていればその相手のライド。
+// 相手のライドの方が先に終わって更新日時が新しくなることがあるので、最新のライドだけでは足りない
+func chairCurrentRides(ctx context.Context, q sqlx.QueryerContext, chairID string) ([]Ride, error) {
+	latest := Ride{}
+	if err := sqlx.GetContext(ctx, q, &latest, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chairID); err != nil {
+		return nil, err
+	}
+	rides := []Ride{latest}
+	if latest.PooledWith.Valid {
+		partner := Ride{}
+		if err := sqlx.GetContext(ctx, q, &partner, `SELECT * FROM rides WHERE id = ? AND chair_id = ?`, latest.PooledWith.String, chairID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+		} else {
+			rides = append(rides, partner)
+		}
+	}
+	return rides, nil
+}
+
+// 椅子に割り当てられているライドのうち、終わっていないものの最新の状態。相乗りの相手のライドも見る。無ければ nil
+func (h *apiHandler) chairActiveRideStatus(ctx context.Context, q sqlx.QueryerContext, chairID string) (*string, error) {
+	rides, err := chairCurrentRides(ctx, q, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, ride := range rides {
+		status, err := h.rideStatus.getLatestRideStatus(ctx, ride.ID)
+		if err != nil {
+			return nil, err
+		}
+		if status != "COMPLETED" && status != "CANCELED" {
+			return &status, nil
+		}
+	}
+	return nil, nil
+}
+
+// 相乗り中の椅子に次に通知するライド。まだ椅子に送っていない状態があればそのうち古いものを、
+// 無ければ終わっていないライドを選ぶ
+func (h *apiHandler) chairNotificationRide(ctx context.Context, rides []Ride) (*Ride, error) {
+	var pending *Ride
+	var pendingStatus *RideStatus
+	var active *Ride
+	for i := range rides {
+		ride := &rides[i]
+		yetSent, err := h.rideStatus.findRideStatusYetSentByChair(ctx, ride.ID)
+		if err != nil {
+			if !errors.Is(err, errorNoMatchingRideStatus) {
+				return nil, err
+			}
+		} else if pendingStatus == nil || yetSent.CreatedAt.Before(pendingStatus.CreatedAt) {
+			pending = ride
+			pendingStatus = yetSent
+		}
+		status, err := h.rideStatus.getLatestRideStatus(ctx, ride.ID)
+		if err != nil {
+			return nil, err
+		}
+		if active == nil && status != "COMPLETED" {
+			active = ride
+		}
+	}
+	if pending != nil {
+		return pending, nil
+	}
+	if active != nil {
+		return active, nil
+	}
+	return &rides[0], nil
+}
+
+// 相乗りの相手のライドが同じ椅子でまだ終わっていないか
+func (h *apiHandler) poolPartnerActive(ctx context.Context, q sqlx.QueryerContext, ride *Ride) (bool, error) {
+	if !ride.PooledWith.Valid {
+		return false, nil
+	}
+	partner := Ride{}
+	if err := sqlx.GetContext(ctx, q, &partner, `SELECT * FROM rides WHERE id = ?`, ride.PooledWith.String); err != nil {
+		return false, err
+	}
+	if partner.ChairID != ride.ChairID {
+		return false, nil
+	}
+	status, err := h.rideStatus.getLatestRideStatus(ctx, partner.ID)
+	if err != nil {
+		return false, err
+	}
+	return status != "COMPLETED", nil
+}
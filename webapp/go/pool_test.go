@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/motoki317/sc"
+)
+
+func TestPoolDetours(t *testing.T) {
+	at := func(lat, lon int) Coordinate { return Coordinate{Latitude: lat, Longitude: lon} }
+	tests := []struct {
+		name            string
+		current         Coordinate
+		hostDestination Coordinate
+		pickup          Coordinate
+		destination     Coordinate
+		wantHostDetour  int
+		wantGuestDetour int
+	}{
+		{name: "乗車地が道中にあり目的地がその先", current: at(0, 0), hostDestination: at(10, 0), pickup: at(5, 0), destination: at(20, 0), wantHostDetour: 0, wantGuestDetour: 0},
+		{name: "乗車地が道から外れている", current: at(0, 0), hostDestination: at(10, 0), pickup: at(5, 5), destination: at(10, 5), wantHostDetour: 10, wantGuestDetour: 10},
+		{name: "乗車地が椅子の後ろ", current: at(0, 0), hostDestination: at(10, 0), pickup: at(-5, 0), destination: at(10, 0), wantHostDetour: 10, wantGuestDetour: 0},
+		{name: "相乗り客の目的地が引き返した先", current: at(0, 0), hostDestination: at(10, 0), pickup: at(5, 0), destination: at(0, 0), wantHostDetour: 0, wantGuestDetour: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, guest := poolDetours(tt.current, tt.hostDestination, tt.pickup, tt.destination)
+			if host != tt.wantHostDetour || guest != tt.wantGuestDetour {
+				t.Errorf("poolDetours() = (%d, %d), want (%d, %d)", host, guest, tt.wantHostDetour, tt.wantGuestDetour)
+			}
+		})
+	}
+}
+
+// 状態の履歴を DB ではなく statuses から読む apiHandler
+func newTestRideStatusHandler(t *testing.T, statuses map[string][]RideStatus) *apiHandler {
+	t.Helper()
+	replace := func(_ context.Context, rideID string) ([]RideStatus, error) {
+		return statuses[rideID], nil
+	}
+	cache, err := sc.New[string, []RideStatus](replace, time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiHandler{rideStatus: &rideStatusManager{scacheByRideID: cache}}
+}
+
+func TestChairNotificationRide(t *testing.T) {
+	base := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	sent := &base
+	status := func(status string, minute int, chairSentAt *time.Time) RideStatus {
+		return RideStatus{Status: status, CreatedAt: base.Add(time.Duration(minute) * time.Minute), ChairSentAt: chairSentAt}
+	}
+
+	tests := []struct {
+		name     string
+		statuses map[string][]RideStatus
+		want     string
+	}{
+		{
+			name: "未通知の状態があるライドを優先する",
+			statuses: map[string][]RideStatus{
+				"host":  {status("MATCHING", 0, sent), status("ENROUTE", 1, sent)},
+				"guest": {status("MATCHING", 2, sent), status("ENROUTE", 3, nil)},
+			},
+			want: "guest",
+		},
+		{
+			name: "どちらも未通知なら古い状態のライド",
+			statuses: map[string][]RideStatus{
+				"host":  {status("MATCHING", 0, sent), status("ARRIVED", 5, nil)},
+				"guest": {status("MATCHING", 2, sent), status("PICKUP", 3, nil)},
+			},
+			want: "guest",
+		},
+		{
+			name: "未通知が無ければ終わっていないライド",
+			statuses: map[string][]RideStatus{
+				"host":  {status("MATCHING", 0, sent), status("COMPLETED", 5, sent)},
+				"guest": {status("MATCHING", 2, sent), status("CARRYING", 3, sent)},
+			},
+			want: "guest",
+		},
+		{
+			name: "終わったライドの未通知の状態は終わっていないライドより先",
+			statuses: map[string][]RideStatus{
+				"host":  {status("MATCHING", 0, sent), status("COMPLETED", 5, nil)},
+				"guest": {status("MATCHING", 2, sent), status("CARRYING", 3, sent)},
+			},
+			want: "host",
+		},
+		{
+			name: "すべて終わっていれば最初のライド",
+			statuses: map[string][]RideStatus{
+				"host":  {status("MATCHING", 0, sent), status("COMPLETED", 5, sent)},
+				"guest": {status("MATCHING", 2, sent), status("COMPLETED", 6, sent)},
+			},
+			want: "host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestRideStatusHandler(t, tt.statuses)
+			ride, err := h.chairNotificationRide(context.Background(), []Ride{{ID: "host"}, {ID: "guest"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ride.ID != tt.want {
+				t.Errorf("chairNotificationRide() = %s, want %s", ride.ID, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	initialFare     = 500
+	farePerDistance = 100
+)
+
+// fareRate は椅子モデルごとの運賃レート
+type fareRate struct {
+	InitialFare     int
+	FarePerDistance int
+}
+
+// 椅子が未割り当ての見積もりや、レートが未登録のモデルにはこのレートを使う
+var defaultFareRate = fareRate{
+	InitialFare:     initialFare,
+	FarePerDistance: farePerDistance,
+}
+
+// 初乗りを除いた距離ぶんの運賃。サージ倍率(%)はここにだけ掛ける
+func (r fareRate) meteredFare(distance int, surgeRate int) int {
+	return r.FarePerDistance * distance * surgeRate / 100
+}
+
+func (r fareRate) fare(distance int, surgeRate int) int {
+	return r.InitialFare + r.meteredFare(distance, surgeRate)
+}
+
+// クーポンの割引は距離ぶんの運賃にだけ適用し、初乗り運賃は必ず払ってもらう
+func (r fareRate) discountedFare(distance int, surgeRate int, discount int) int {
+	return r.InitialFare + max(r.meteredFare(distance, surgeRate)-discount, 0)
+}
+
+// rideFare はライドの請求額とその内訳
+type rideFare struct {
+	Rate fareRate
+	// 割引後の請求額
+	Fare int
+	// 実際に適用されたクーポン割引額
+	Discount     int
+	PoolDiscount int
+}
+
+// 相乗り割引を先に距離ぶんの運賃から引き、クーポンはその残りに適用する
+func (r fareRate) price(distance int, surgeRate int, poolDiscountPercent int, couponDiscount int) rideFare {
+	poolDiscount := r.meteredFare(distance, surgeRate) * poolDiscountPercent / 100
+	fare := r.discountedFare(distance, surgeRate, poolDiscount+couponDiscount)
+	return rideFare{
+		Rate:         r,
+		Fare:         fare,
+		Discount:     r.fare(distance, surgeRate) - poolDiscount - fare,
+		PoolDiscount: poolDiscount,
+	}
+}
+
+// pricingEngine は chair_models をメモリに持ち、モデルごとのレートと速度を返す。
+// chair_models は初期化以外で変わらないので、起動時と初期化時にまとめて読み直す
+type pricingEngine struct {
+	mu     sync.RWMutex
+	models map[string]ChairModel
+}
+
+func newPricingEngine() *pricingEngine {
+	return &pricingEngine{
+		models: map[string]ChairModel{},
+	}
+}
+
+// chair_models からモデルごとのレートと速度を読み直す
+func (e *pricingEngine) load(ctx context.Context, db *sqlx.DB) error {
+	models := []ChairModel{}
+	if err := db.SelectContext(ctx, &models, "SELECT * FROM chair_models"); err != nil {
+		return err
+	}
+
+	byName := make(map[string]ChairModel, len(models))
+	for _, model := range models {
+		byName[model.Name] = model
+	}
+
+	e.mu.Lock()
+	e.models = byName
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *pricingEngine) rateFor(model string) fareRate {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if m, ok := e.models[model]; ok {
+		return fareRate{
+			InitialFare:     m.InitialFare,
+			FarePerDistance: m.FarePerDistance,
+		}
+	}
+	return defaultFareRate
+}
+
+// 1回の移動で進む距離。未登録のモデルなら false
+func (e *pricingEngine) speedFor(model string) (int, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	m, ok := e.models[model]
+	return m.Speed, ok
+}
+
+// 割り当てた椅子のモデルのレートでライドの運賃を計算し直す。サージ倍率とクーポンはライド作成時に確定したものを使う。
+// 見積もりで運賃が確定しているライドは計算し直さず、保存してある運賃をそのまま返す
+func (h *apiHandler) priceRideForModel(ctx context.Context, q sqlx.QueryerContext, ride *Ride, model string) (rideFare, error) {
+	if ride.PriceLocked {
+		return rideFare{
+			Rate:         fareRate{InitialFare: ride.InitialFare, FarePerDistance: ride.FarePerDistance},
+			Fare:         ride.Fare,
+			Discount:     ride.Discount,
+			PoolDiscount: ride.PoolDiscount,
+		}, nil
+	}
+	waypoints, err := getRideWaypoints(ctx, q, ride.ID)
+	if err != nil {
+		return rideFare{}, err
+	}
+	couponDiscount := 0
+	if ride.CouponCode != nil {
+		if err := h.db2.GetContext(ctx, &couponDiscount, "SELECT discount FROM coupons WHERE user_id = ? AND code = ?", ride.UserID, *ride.CouponCode); err != nil {
+			return rideFare{}, err
+		}
+	}
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	distance := routeDistance(pickup, waypointCoordinates(waypoints), destination)
+	return h.pricing.rateFor(model).price(distance, ride.SurgeRate, h.pool.discountPercent(ride.Pooled), couponDiscount), nil
+}
+
+func (h *apiHandler) initPricingEngine(ctx context.Context) error {
+	return h.pricing.load(ctx, h.db)
+}
+
+// 一度に読むライドの数。IN 句のプレースホルダが多くなりすぎないようにする
+const backfillRideCouponsBatchSize = 1000
+
+// 初期データのライドに、使われたクーポンの割引を反映する。クーポンは DB2 にあるので 5-migration.sql では埋められない。
+// 作成時にクーポンを保存したライドは変えないので、何度実行してもよい
+// updated_at は完了日時として売上の集計に使うので変えない
+func backfillRideCoupons(ctx context.Context, db, db2 *sqlx.DB) (int, error) {
+	coupons := []Coupon{}
+	if err := db2.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE used_by IS NOT NULL"); err != nil {
+		return 0, err
+	}
+	couponByRideID := make(map[string]Coupon, len(coupons))
+	rideIDs := make([]string, 0, len(coupons))
+	for _, coupon := range coupons {
+		couponByRideID[*coupon.UsedBy] = coupon
+		rideIDs = append(rideIDs, *coupon.UsedBy)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	updated := 0
+	for start := 0; start < len(rideIDs); start += backfillRideCouponsBatchSize {
+		query, args, err := sqlx.In(
+			"SELECT * FROM rides WHERE id IN (?) AND coupon_code IS NULL FOR UPDATE",
+			rideIDs[start:min(start+backfillRideCouponsBatchSize, len(rideIDs))],
+		)
+		if err != nil {
+			return 0, err
+		}
+		rides := []Ride{}
+		if err := tx.SelectContext(ctx, &rides, query, args...); err != nil {
+			return 0, err
+		}
+		for _, ride := range rides {
+			coupon := couponByRideID[ride.ID]
+			waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+			if err != nil {
+				return 0, err
+			}
+			pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+			destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+			distance := routeDistance(pickup, waypointCoordinates(waypoints), destination)
+			rate := fareRate{InitialFare: ride.InitialFare, FarePerDistance: ride.FarePerDistance}
+			// 初期データに相乗りのライドは無い
+			price := rate.price(distance, ride.SurgeRate, 0, coupon.Discount)
+			if _, err := tx.ExecContext(
+				ctx,
+				"UPDATE rides SET coupon_code = ?, discount = ?, fare = ?, updated_at = updated_at WHERE id = ?",
+				coupon.Code, price.Discount, price.Fare, ride.ID,
+			); err != nil {
+				return 0, err
+			}
+			updated++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
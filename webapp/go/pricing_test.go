@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFareRate(t *testing.T) {
+	rate := fareRate{InitialFare: 500, FarePerDistance: 100}
+	tests := []struct {
+		name           string
+		distance       int
+		surgeRate      int
+		discount       int
+		wantMetered    int
+		wantFare       int
+		wantDiscounted int
+	}{
+		{name: "距離0なら初乗りだけ", distance: 0, surgeRate: noSurgeRate, discount: 0, wantMetered: 0, wantFare: 500, wantDiscounted: 500},
+		{name: "サージ無し", distance: 10, surgeRate: noSurgeRate, discount: 0, wantMetered: 1000, wantFare: 1500, wantDiscounted: 1500},
+		{name: "サージは距離ぶんにだけ掛かる", distance: 10, surgeRate: 150, discount: 0, wantMetered: 1500, wantFare: 2000, wantDiscounted: 2000},
+		{name: "割引は距離ぶんから引く", distance: 10, surgeRate: noSurgeRate, discount: 300, wantMetered: 1000, wantFare: 1500, wantDiscounted: 1200},
+		{name: "割引が距離ぶんを超えても初乗りは払う", distance: 3, surgeRate: noSurgeRate, discount: 3000, wantMetered: 300, wantFare: 800, wantDiscounted: 500},
+		{name: "割引はサージ後の運賃に適用する", distance: 10, surgeRate: 200, discount: 1500, wantMetered: 2000, wantFare: 2500, wantDiscounted: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rate.meteredFare(tt.distance, tt.surgeRate); got != tt.wantMetered {
+				t.Errorf("meteredFare() = %d, want %d", got, tt.wantMetered)
+			}
+			if got := rate.fare(tt.distance, tt.surgeRate); got != tt.wantFare {
+				t.Errorf("fare() = %d, want %d", got, tt.wantFare)
+			}
+			if got := rate.discountedFare(tt.distance, tt.surgeRate, tt.discount); got != tt.wantDiscounted {
+				t.Errorf("discountedFare() = %d, want %d", got, tt.wantDiscounted)
+			}
+		})
+	}
+}
+
+func TestFareRatePrice(t *testing.T) {
+	rate := fareRate{InitialFare: 300, FarePerDistance: 200}
+	tests := []struct {
+		name                string
+		distance            int
+		surgeRate           int
+		poolDiscountPercent int
+		couponDiscount      int
+		want                rideFare
+	}{
+		{
+			name:      "割引無し",
+			distance:  10,
+			surgeRate: noSurgeRate,
+			want:      rideFare{Rate: rate, Fare: 2300},
+		},
+		{
+			name:           "クーポン",
+			distance:       10,
+			surgeRate:      noSurgeRate,
+			couponDiscount: 500,
+			want:           rideFare{Rate: rate, Fare: 1800, Discount: 500},
+		},
+		{
+			name:           "クーポンは距離ぶんまでしか効かない",
+			distance:       2,
+			surgeRate:      noSurgeRate,
+			couponDiscount: 3000,
+			want:           rideFare{Rate: rate, Fare: 300, Discount: 400},
+		},
+		{
+			name:                "相乗り割引の残りにクーポンを適用する",
+			distance:            10,
+			surgeRate:           noSurgeRate,
+			poolDiscountPercent: 20,
+			couponDiscount:      3000,
+			want:                rideFare{Rate: rate, Fare: 300, Discount: 1600, PoolDiscount: 400},
+		},
+		{
+			name:                "相乗り割引はサージ後の距離ぶんに掛ける",
+			distance:            10,
+			surgeRate:           150,
+			poolDiscountPercent: 20,
+			want:                rideFare{Rate: rate, Fare: 2700, PoolDiscount: 600},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rate.price(tt.distance, tt.surgeRate, tt.poolDiscountPercent, tt.couponDiscount)
+			if got != tt.want {
+				t.Errorf("price() = %+v, want %+v", got, tt.want)
+			}
+			if full := rate.fare(tt.distance, tt.surgeRate); got.Fare+got.Discount+got.PoolDiscount != full {
+				t.Errorf("fare + discounts = %d, want %d", got.Fare+got.Discount+got.PoolDiscount, full)
+			}
+		})
+	}
+}
+
+func TestPricingEngineRateFor(t *testing.T) {
+	fast := fareRate{InitialFare: 800, FarePerDistance: 150}
+	e := newPricingEngine()
+	e.models = map[string]ChairModel{"fast": {Name: "fast", Speed: 7, InitialFare: 800, FarePerDistance: 150}}
+
+	tests := []struct {
+		name  string
+		model string
+		want  fareRate
+	}{
+		{name: "登録されたモデル", model: "fast", want: fast},
+		{name: "未登録のモデルはデフォルト", model: "unknown", want: defaultFareRate},
+		{name: "モデル名が空ならデフォルト", model: "", want: defaultFareRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.rateFor(tt.model); got != tt.want {
+				t.Errorf("rateFor(%q) = %+v, want %+v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPricingEngineSpeedFor(t *testing.T) {
+	e := newPricingEngine()
+	e.models = map[string]ChairModel{"fast": {Name: "fast", Speed: 7, InitialFare: 800, FarePerDistance: 150}}
+
+	if speed, ok := e.speedFor("fast"); !ok || speed != 7 {
+		t.Errorf("speedFor(fast) = %d, %v, want 7, true", speed, ok)
+	}
+	if _, ok := e.speedFor("unknown"); ok {
+		t.Error("speedFor(unknown) should report an unknown model")
+	}
+}
+
+func TestPriceRideForModelLocked(t *testing.T) {
+	h := &apiHandler{pricing: newPricingEngine()}
+	h.pricing.models = map[string]ChairModel{"fast": {Name: "fast", Speed: 7, InitialFare: 800, FarePerDistance: 150}}
+
+	// 見積もりで確定したライドは、椅子のモデルのレートが違っても保存してある運賃のまま
+	ride := &Ride{PriceLocked: true, InitialFare: 500, FarePerDistance: 100, Fare: 1200, Discount: 300, PoolDiscount: 0}
+	got, err := h.priceRideForModel(context.Background(), nil, ride, "fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rideFare{Rate: defaultFareRate, Fare: 1200, Discount: 300}
+	if got != want {
+		t.Errorf("priceRideForModel() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 見積もりの有効期限
+const quoteTTL = 3 * time.Minute
+
+var (
+	errInvalidQuote = errors.New("invalid quote_id")
+	errExpiredQuote = errors.New("quote_id has expired")
+	errNoQuoteKey   = errors.New("quote signing key is not loaded")
+)
+
+// fareQuote は見積もり時点の運賃を固定するための内容。quote_id にはこれを署名して埋め込む
+type fareQuote struct {
+	UserID       string       `json:"user_id"`
+	Pickup       Coordinate   `json:"pickup"`
+	Destination  Coordinate   `json:"destination"`
+	Waypoints    []Coordinate `json:"waypoints,omitempty"`
+	Fare         int          `json:"fare"`
+	Discount     int          `json:"discount"`
+	Pooled       bool         `json:"pooled,omitempty"`
+	PoolDiscount int          `json:"pool_discount,omitempty"`
+	SurgeRate    int          `json:"surge_rate"`
+	CouponCode   string       `json:"coupon_code,omitempty"`
+	ExpiresAt    int64        `json:"expires_at"`
+}
+
+// 見積もりと同じ利用者・経路の配車依頼か
+func (q *fareQuote) matches(userID string, pickup, destination Coordinate, waypoints []Coordinate, pooled bool) bool {
+	return q.UserID == userID && q.Pickup == pickup && q.Destination == destination && slices.Equal(q.Waypoints, waypoints) && q.Pooled == pooled
+}
+
+// quoteSigner は quote_id の署名鍵を持つ。鍵を読み込むまでは発行も検証もしない
+type quoteSigner struct {
+	mu     sync.RWMutex
+	secret []byte
+}
+
+func newQuoteSigner(secret []byte) *quoteSigner {
+	return &quoteSigner{secret: secret}
+}
+
+// 署名鍵を読み込む。ISUCON_QUOTE_SECRET があればそれを、無ければ settings の quote_secret を使い、
+// 無ければ作って保存する。再起動しても、ほかのノードでも同じ鍵になるので、発行済みの quote_id はそのまま使える
+func (s *quoteSigner) load(ctx context.Context, db *sqlx.DB) error {
+	if secret := os.Getenv("ISUCON_QUOTE_SECRET"); secret != "" {
+		s.setSecret([]byte(secret))
+		return nil
+	}
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return err
+	}
+	// 同時に起動したノードがあっても、先に保存された鍵にそろえる
+	if _, err := db.ExecContext(ctx, "INSERT IGNORE INTO settings (name, value) VALUES ('quote_secret', ?)", hex.EncodeToString(b)); err != nil {
+		return err
+	}
+	var secret string
+	if err := db.GetContext(ctx, &secret, "SELECT value FROM settings WHERE name = 'quote_secret'"); err != nil {
+		return err
+	}
+	s.setSecret([]byte(secret))
+	return nil
+}
+
+func (s *quoteSigner) setSecret(secret []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secret = secret
+}
+
+func (s *quoteSigner) mac(payload string) (string, error) {
+	s.mu.RLock()
+	secret := s.secret
+	s.mu.RUnlock()
+	if len(secret) == 0 {
+		return "", errNoQuoteKey
+	}
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil)), nil
+}
+
+// "<payload>.<signature>" 形式の quote_id を発行する
+func (s *quoteSigner) sign(quote *fareQuote) (string, error) {
+	b, err := json.Marshal(quote)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	signature, err := s.mac(payload)
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + signature, nil
+}
+
+func (s *quoteSigner) verify(quoteID string, now time.Time) (*fareQuote, error) {
+	payload, signature, ok := strings.Cut(quoteID, ".")
+	if !ok {
+		return nil, errInvalidQuote
+	}
+	expected, err := s.mac(payload)
+	if err != nil {
+		return nil, errInvalidQuote
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, errInvalidQuote
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidQuote
+	}
+	quote := &fareQuote{}
+	if err := json.Unmarshal(b, quote); err != nil {
+		return nil, errInvalidQuote
+	}
+	if now.UnixMilli() > quote.ExpiresAt {
+		return nil, errExpiredQuote
+	}
+	return quote, nil
+}
+
+func (h *apiHandler) initQuoteSigner(ctx context.Context) error {
+	return h.quoteSigner.load(ctx, h.db)
+}
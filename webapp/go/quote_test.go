@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestQuote(now time.Time) *fareQuote {
+	return &fareQuote{
+		UserID:      "user",
+		Pickup:      Coordinate{Latitude: 0, Longitude: 0},
+		Destination: Coordinate{Latitude: 10, Longitude: 10},
+		Fare:        2500,
+		SurgeRate:   noSurgeRate,
+		ExpiresAt:   now.Add(quoteTTL).UnixMilli(),
+	}
+}
+
+func TestQuoteSignerVerify(t *testing.T) {
+	now := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	s := newQuoteSigner([]byte("secret"))
+	quoteID, err := s.sign(newTestQuote(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(quoteID, ".")
+
+	// 運賃を書き換えて、元の署名を付け直したもの
+	tampered := newTestQuote(now)
+	tampered.Fare = 1
+	b, err := json.Marshal(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedPayload := base64.RawURLEncoding.EncodeToString(b)
+
+	tests := []struct {
+		name    string
+		signer  *quoteSigner
+		quoteID string
+		now     time.Time
+		wantErr error
+	}{
+		{name: "正しい見積もり", signer: s, quoteID: quoteID, now: now, wantErr: nil},
+		{name: "有効期限ちょうど", signer: s, quoteID: quoteID, now: now.Add(quoteTTL), wantErr: nil},
+		{name: "有効期限切れ", signer: s, quoteID: quoteID, now: now.Add(quoteTTL + time.Millisecond), wantErr: errExpiredQuote},
+		{name: "中身を書き換えた", signer: s, quoteID: tamperedPayload + "." + signature, now: now, wantErr: errInvalidQuote},
+		{name: "署名を書き換えた", signer: s, quoteID: payload + "." + signature[:len(signature)-1] + "A", now: now, wantErr: errInvalidQuote},
+		{name: "署名が無い", signer: s, quoteID: payload, now: now, wantErr: errInvalidQuote},
+		{name: "別の鍵で署名した", signer: newQuoteSigner([]byte("other")), quoteID: quoteID, now: now, wantErr: errInvalidQuote},
+		{name: "鍵を読み込んでいない", signer: newQuoteSigner(nil), quoteID: quoteID, now: now, wantErr: errInvalidQuote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := tt.signer.verify(tt.quoteID, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && quote.Fare != 2500 {
+				t.Errorf("fare = %d, want 2500", quote.Fare)
+			}
+		})
+	}
+}
+
+func TestQuoteSignerSignWithoutKey(t *testing.T) {
+	if _, err := newQuoteSigner(nil).sign(newTestQuote(time.Now())); !errors.Is(err, errNoQuoteKey) {
+		t.Fatalf("sign() error = %v, want %v", err, errNoQuoteKey)
+	}
+}
+
+func TestFareQuoteMatches(t *testing.T) {
+	quote := newTestQuote(time.Now())
+	quote.Waypoints = []Coordinate{{Latitude: 5, Longitude: 5}}
+	tests := []struct {
+		name        string
+		userID      string
+		pickup      Coordinate
+		destination Coordinate
+		waypoints   []Coordinate
+		pooled      bool
+		want        bool
+	}{
+		{name: "同じ依頼", userID: "user", pickup: quote.Pickup, destination: quote.Destination, waypoints: quote.Waypoints, want: true},
+		{name: "別の利用者", userID: "other", pickup: quote.Pickup, destination: quote.Destination, waypoints: quote.Waypoints, want: false},
+		{name: "乗車地が違う", userID: "user", pickup: Coordinate{Latitude: 1}, destination: quote.Destination, waypoints: quote.Waypoints, want: false},
+		{name: "目的地が違う", userID: "user", pickup: quote.Pickup, destination: Coordinate{Latitude: 11, Longitude: 10}, waypoints: quote.Waypoints, want: false},
+		{name: "立ち寄り地点が違う", userID: "user", pickup: quote.Pickup, destination: quote.Destination, waypoints: nil, want: false},
+		{name: "相乗りかどうかが違う", userID: "user", pickup: quote.Pickup, destination: quote.Destination, waypoints: quote.Waypoints, pooled: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quote.matches(tt.userID, tt.pickup, tt.destination, tt.waypoints, tt.pooled); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
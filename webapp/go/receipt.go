@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+type appGetRideReceiptResponse struct {
+	RideID                string                       `json:"ride_id"`
+	PickupCoordinate      Coordinate                   `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
+	Waypoints             []rideWaypointResponse       `json:"waypoints,omitempty"`
+	Distance              int                          `json:"distance"`
+	BaseFare              int                          `json:"base_fare"`
+	MeteredFare           int                          `json:"metered_fare"`
+	SurgeMultiplier       float64                      `json:"surge_multiplier"`
+	SurgeFare             int                          `json:"surge_fare"`
+	CouponCode            *string                      `json:"coupon_code"`
+	Discount              int                          `json:"discount"`
+	PoolDiscount          int                          `json:"pool_discount"`
+	Fare                  int                          `json:"fare"`
+	PaymentStatus         string                       `json:"payment_status"`
+	Chair                 getAppRidesResponseItemChair `json:"chair"`
+	RequestedAt           int64                        `json:"requested_at"`
+	CompletedAt           int64                        `json:"completed_at"`
+}
+
+// 決済は評価時に行われ、成功したときだけ COMPLETED になるので、領収書を出すライドは支払い済み
+const paymentStatusPaid = "PAID"
+
+// 完了したライドの領収書。format(json, text, html) か Accept ヘッダで形式を選ぶ
+func (h *apiHandler) appGetRideReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+	format, err := receiptFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ride := &Ride{}
+	if err := h.db.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? AND user_id = ?`, rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status, err := h.getLatestRideStatusDetail(ctx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 到着しただけでまだ支払われていないライドには出さない
+	if status.Status != "COMPLETED" {
+		writeError(w, http.StatusBadRequest, errors.New("ride has not been completed yet"))
+		return
+	}
+
+	chair := &Chair{}
+	if err := h.db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	owner := &Owner{}
+	if err := h.db2.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	waypoints, err := getRideWaypoints(ctx, h.db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 内訳は運賃の計算に使ったレートで出す。その後にモデルのレートが変わっても請求額と食い違わない
+	rate := fareRate{InitialFare: ride.InitialFare, FarePerDistance: ride.FarePerDistance}
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	distance := routeDistance(pickup, waypointCoordinates(waypoints), destination)
+	meteredFare := rate.meteredFare(distance, noSurgeRate)
+	res := &appGetRideReceiptResponse{
+		RideID:                ride.ID,
+		PickupCoordinate:      pickup,
+		DestinationCoordinate: destination,
+		Waypoints:             newRideWaypointsResponse(waypoints),
+		Distance:              distance,
+		BaseFare:              rate.InitialFare,
+		MeteredFare:           meteredFare,
+		SurgeMultiplier:       surgeMultiplier(ride.SurgeRate),
+		SurgeFare:             rate.meteredFare(distance, ride.SurgeRate) - meteredFare,
+		CouponCode:            ride.CouponCode,
+		Discount:              ride.Discount,
+		PoolDiscount:          ride.PoolDiscount,
+		Fare:                  ride.Fare,
+		PaymentStatus:         paymentStatusPaid,
+		Chair: getAppRidesResponseItemChair{
+			ID:    chair.ID,
+			Owner: owner.Name,
+			Name:  chair.Name,
+			Model: chair.Model,
+		},
+		RequestedAt: ride.CreatedAt.UnixMilli(),
+		CompletedAt: status.CreatedAt.UnixMilli(),
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "text":
+		if err := receiptTextTemplate.Execute(&buf, res); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	case "html":
+		if err := receiptHTMLTemplate.Execute(&buf, res); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	case "json":
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// format があればそれを、無ければ Accept ヘッダから形式を選ぶ。知らない format はエラーにする
+func receiptFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "json", "text", "html":
+		return format, nil
+	case "":
+	default:
+		return "", errors.New("format must be json, text or html")
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/html"):
+		return "html", nil
+	case strings.Contains(accept, "text/plain"):
+		return "text", nil
+	default:
+		return "json", nil
+	}
+}
+
+var receiptTemplateFuncs = map[string]any{
+	"datetime": func(ms int64) string {
+		return time.UnixMilli(ms).Format("2006-01-02 15:04:05")
+	},
+}
+
+var receiptTextTemplate = texttemplate.Must(texttemplate.New("receipt").Funcs(receiptTemplateFuncs).Parse(`ISURIDE 領収書
+ライドID: {{.RideID}}
+乗車日時: {{datetime .RequestedAt}}
+到着日時: {{datetime .CompletedAt}}
+乗車地:   ({{.PickupCoordinate.Latitude}}, {{.PickupCoordinate.Longitude}})
+目的地:   ({{.DestinationCoordinate.Latitude}}, {{.DestinationCoordinate.Longitude}})
+椅子:     {{.Chair.Name}} ({{.Chair.Model}}) / {{.Chair.Owner}}
+
+初乗り運賃:       {{.BaseFare}}円
+距離運賃({{.Distance}}):   {{.MeteredFare}}円
+サージ(x{{.SurgeMultiplier}}):   {{.SurgeFare}}円
+{{if .PoolDiscount}}相乗り割引:       -{{.PoolDiscount}}円
+{{end}}クーポン割引{{if .CouponCode}}({{.CouponCode}}){{end}}: -{{.Discount}}円
+お支払い金額:     {{.Fare}}円
+支払い状況:       {{.PaymentStatus}}
+`))
+
+var receiptHTMLTemplate = htmltemplate.Must(htmltemplate.New("receipt").Funcs(receiptTemplateFuncs).Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head><meta charset="utf-8"><title>ISURIDE 領収書 {{.RideID}}</title></head>
+<body>
+<h1>ISURIDE 領収書</h1>
+<dl>
+  <dt>ライドID</dt><dd>{{.RideID}}</dd>
+  <dt>乗車日時</dt><dd>{{datetime .RequestedAt}}</dd>
+  <dt>到着日時</dt><dd>{{datetime .CompletedAt}}</dd>
+  <dt>乗車地</dt><dd>({{.PickupCoordinate.Latitude}}, {{.PickupCoordinate.Longitude}})</dd>
+  <dt>目的地</dt><dd>({{.DestinationCoordinate.Latitude}}, {{.DestinationCoordinate.Longitude}})</dd>
+  <dt>椅子</dt><dd>{{.Chair.Name}} ({{.Chair.Model}}) / {{.Chair.Owner}}</dd>
+</dl>
+<table>
+  <tr><th>初乗り運賃</th><td>{{.BaseFare}}円</td></tr>
+  <tr><th>距離運賃({{.Distance}})</th><td>{{.MeteredFare}}円</td></tr>
+  <tr><th>サージ(x{{.SurgeMultiplier}})</th><td>{{.SurgeFare}}円</td></tr>
+  {{if .PoolDiscount}}<tr><th>相乗り割引</th><td>-{{.PoolDiscount}}円</td></tr>{{end}}
+  <tr><th>クーポン割引{{if .CouponCode}}({{.CouponCode}}){{end}}</th><td>-{{.Discount}}円</td></tr>
+  <tr><th>お支払い金額</th><td>{{.Fare}}円</td></tr>
+  <tr><th>支払い状況</th><td>{{.PaymentStatus}}</td></tr>
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReceiptFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    string
+		wantErr bool
+	}{
+		{name: "指定無し", want: "json"},
+		{name: "format=text", query: "?format=text", want: "text"},
+		{name: "format=html", query: "?format=html", want: "html"},
+		{name: "format は Accept より優先する", query: "?format=json", accept: "text/html", want: "json"},
+		{name: "Accept が HTML", accept: "text/html,application/xhtml+xml", want: "html"},
+		{name: "Accept がテキスト", accept: "text/plain", want: "text"},
+		{name: "知らない Accept は JSON", accept: "application/pdf", want: "json"},
+		{name: "知らない format", query: "?format=pdf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/app/rides/ride/receipt"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			got, err := receiptFormat(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("receiptFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("receiptFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -68,6 +68,25 @@ func (h *apiHandler) createRideStatus(ctx context.Context, tx *sqlx.Tx, rideID s
 	return fn, err
 }
 
+// createRideStatus と同じだが、状態になった日時を指定する。まとめて送られた位置から状態を作るときに使う
+func (m *rideStatusManager) createRideStatusAt(ctx context.Context, tx *sqlx.Tx, rideID string, status string, createdAt time.Time) (afterCommitFunc, error) {
+	id := ulid.Make().String()
+	_, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status, created_at) VALUES (?, ?, ?, ?)", id, rideID, status, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	afterCommit := func(ctx context.Context) error {
+		m.scacheByRideID.Forget(rideID)
+		return nil
+	}
+	return afterCommit, nil
+}
+
+func (h *apiHandler) createRideStatusAt(ctx context.Context, tx *sqlx.Tx, rideID string, status string, createdAt time.Time) (afterCommitFunc, error) {
+	fn, err := h.rideStatus.createRideStatusAt(ctx, tx, rideID, status, createdAt)
+	return fn, err
+}
+
 func (m *rideStatusManager) updateRideStatusAppSentAt(ctx context.Context, tx *sqlx.Tx, id string) (afterCommitFunc, error) {
 	_, err := tx.ExecContext(ctx, "UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?", id)
 	if err != nil {
@@ -162,6 +181,26 @@ func (m *rideStatusManager) getLatestRideStatus(ctx context.Context, rideID stri
 	return rideStatuses[len(rideStatuses)-1].Status, nil
 }
 
+// SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1
+func (m *rideStatusManager) getLatestRideStatusDetail(ctx context.Context, rideID string) (*RideStatus, error) {
+	rideStatuses, err := m.scacheByRideID.Get(ctx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rideStatuses) == 0 {
+		return nil, errorNoMatchingRideStatus
+	}
+	rideStatus := rideStatuses[len(rideStatuses)-1]
+	return &rideStatus, nil
+}
+
+func (h *apiHandler) getLatestRideStatusDetail(ctx context.Context, rideID string) (*RideStatus, error) {
+	if h.rideStatus == nil {
+		return nil, errors.New("rideStatusManager is not initialized")
+	}
+	return h.rideStatus.getLatestRideStatusDetail(ctx, rideID)
+}
+
 func (h *apiHandler) getLatestRideStatus(ctx context.Context, _tx executableGet, rideID string) (string, error) {
 	if h.rideStatus == nil {
 		return "", errors.New("rideStatusManager is not initialized")
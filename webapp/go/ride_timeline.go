@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type rideDetailResponse struct {
+	ID                    string                       `json:"id"`
+	PickupCoordinate      Coordinate                   `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
+	Waypoints             []rideWaypointResponse       `json:"waypoints,omitempty"`
+	ChairID               *string                      `json:"chair_id"`
+	Fare                  int                          `json:"fare"`
+	Discount              int                          `json:"discount"`
+	PoolDiscount          int                          `json:"pool_discount"`
+	SurgeMultiplier       float64                      `json:"surge_multiplier"`
+	Pooled                bool                         `json:"pooled"`
+	PooledWith            *string                      `json:"pooled_with,omitempty"`
+	Evaluation            *int                         `json:"evaluation"`
+	Status                string                       `json:"status"`
+	ScheduledAt           *int64                       `json:"scheduled_at,omitempty"`
+	RequestedAt           int64                        `json:"requested_at"`
+	UpdatedAt             int64                        `json:"updated_at"`
+	Timeline              []rideTimelineResponseStatus `json:"timeline"`
+}
+
+// ライドの状態の変化と、それを利用者・椅子に通知した日時。未通知なら null
+type rideTimelineResponseStatus struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	CreatedAt   int64  `json:"created_at"`
+	AppSentAt   *int64 `json:"app_sent_at"`
+	ChairSentAt *int64 `json:"chair_sent_at"`
+}
+
+func unixMilliOrNil(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	v := t.UnixMilli()
+	return &v
+}
+
+// ライドとその状態の履歴を組み立てる。サポートが調べるためのものなので、キャッシュを使わず DB から読む
+func (h *apiHandler) getRideDetail(ctx context.Context, ride *Ride) (*rideDetailResponse, error) {
+	statuses := []RideStatus{}
+	if err := h.db.SelectContext(ctx, &statuses, "SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at, id", ride.ID); err != nil {
+		return nil, err
+	}
+	waypoints, err := getRideWaypoints(ctx, h.db, ride.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rideDetailResponse{
+		ID:                    ride.ID,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Waypoints:             newRideWaypointsResponse(waypoints),
+		Fare:                  ride.Fare,
+		Discount:              ride.Discount,
+		PoolDiscount:          ride.PoolDiscount,
+		SurgeMultiplier:       surgeMultiplier(ride.SurgeRate),
+		Pooled:                ride.Pooled,
+		Evaluation:            ride.Evaluation,
+		RequestedAt:           ride.CreatedAt.UnixMilli(),
+		UpdatedAt:             ride.UpdatedAt.UnixMilli(),
+		Timeline:              make([]rideTimelineResponseStatus, 0, len(statuses)),
+	}
+	if ride.ChairID.Valid {
+		res.ChairID = &ride.ChairID.String
+	}
+	if ride.PooledWith.Valid {
+		res.PooledWith = &ride.PooledWith.String
+	}
+	if ride.ScheduledAt.Valid {
+		res.ScheduledAt = unixMilliOrNil(&ride.ScheduledAt.Time)
+	}
+	for _, status := range statuses {
+		res.Timeline = append(res.Timeline, rideTimelineResponseStatus{
+			ID:          status.ID,
+			Status:      status.Status,
+			CreatedAt:   status.CreatedAt.UnixMilli(),
+			AppSentAt:   unixMilliOrNil(status.AppSentAt),
+			ChairSentAt: unixMilliOrNil(status.ChairSentAt),
+		})
+		res.Status = status.Status
+	}
+	return res, nil
+}
+
+// 自分のライドの詳細と状態の履歴
+func (h *apiHandler) appGetRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	ride := &Ride{}
+	if err := h.db.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? AND user_id = ?", r.PathValue("ride_id"), user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, err := h.getRideDetail(ctx, ride)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 椅子に割り当てられているライドの詳細と状態の履歴。配車し直されて外れたライドは見えない
+func (h *apiHandler) chairGetRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	ride := &Ride{}
+	if err := h.db.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? AND chair_id = ?", r.PathValue("ride_id"), chair.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, err := h.getRideDetail(ctx, ride)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
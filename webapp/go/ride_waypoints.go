@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 1ライドで乗車地と目的地の間に立ち寄れる地点の最大数
+const maxRideWaypoints = 5
+
+var (
+	errTooManyWaypoints = fmt.Errorf("waypoints must be at most %d", maxRideWaypoints)
+	errSameAsPrevStop   = errors.New("each waypoint and the destination must differ from the previous stop")
+)
+
+const (
+	rideWaypointStatusPending = "PENDING"
+	rideWaypointStatusArrived = "ARRIVED"
+)
+
+// 乗車地から立ち寄り地点を順に回って目的地に着くまでの距離。区間ごとのマンハッタン距離の合計
+func routeDistance(pickup Coordinate, waypoints []Coordinate, destination Coordinate) int {
+	distance := 0
+	prev := pickup
+	for _, waypoint := range waypoints {
+		distance += calculateDistance(prev.Latitude, prev.Longitude, waypoint.Latitude, waypoint.Longitude)
+		prev = waypoint
+	}
+	return distance + calculateDistance(prev.Latitude, prev.Longitude, destination.Latitude, destination.Longitude)
+}
+
+// 到着は位置が届いたときに1つずつしか判定しないので、直前の地点と同じ地点には着いたことにならず、そこでライドが進まなくなる。
+// そのため乗車地・立ち寄り地点・目的地で、続けて同じ地点は受け付けない
+func validateWaypoints(area *serviceArea, pickup Coordinate, waypoints []Coordinate, destination Coordinate) error {
+	if len(waypoints) > maxRideWaypoints {
+		return errTooManyWaypoints
+	}
+	prev := pickup
+	for _, waypoint := range waypoints {
+		if !area.contains(waypoint) {
+			return errOutOfServiceArea
+		}
+		if waypoint == prev {
+			return errSameAsPrevStop
+		}
+		prev = waypoint
+	}
+	if len(waypoints) > 0 && destination == prev {
+		return errSameAsPrevStop
+	}
+	return nil
+}
+
+func insertRideWaypoints(ctx context.Context, tx sqlx.ExtContext, rideID string, waypoints []Coordinate) error {
+	if len(waypoints) == 0 {
+		return nil
+	}
+	rows := make([]RideWaypoint, 0, len(waypoints))
+	for i, waypoint := range waypoints {
+		rows = append(rows, RideWaypoint{
+			RideID:    rideID,
+			Position:  i + 1,
+			Latitude:  waypoint.Latitude,
+			Longitude: waypoint.Longitude,
+		})
+	}
+	_, err := sqlx.NamedExecContext(
+		ctx, tx,
+		`INSERT INTO ride_waypoints (ride_id, position, latitude, longitude) VALUES (:ride_id, :position, :latitude, :longitude)`,
+		rows,
+	)
+	return err
+}
+
+// 立ち寄り地点を回る順に返す。無ければ空
+func getRideWaypoints(ctx context.Context, q sqlx.QueryerContext, rideID string) ([]RideWaypoint, error) {
+	waypoints := []RideWaypoint{}
+	if err := sqlx.SelectContext(ctx, q, &waypoints, "SELECT * FROM ride_waypoints WHERE ride_id = ? ORDER BY position", rideID); err != nil {
+		return nil, err
+	}
+	return waypoints, nil
+}
+
+func waypointCoordinates(waypoints []RideWaypoint) []Coordinate {
+	coordinates := make([]Coordinate, 0, len(waypoints))
+	for _, waypoint := range waypoints {
+		coordinates = append(coordinates, Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude})
+	}
+	return coordinates
+}
+
+// まだ着いていない最初の立ち寄り地点。全部回っていれば nil
+func nextRideWaypoint(waypoints []RideWaypoint) *RideWaypoint {
+	for i := range waypoints {
+		if !waypoints[i].ArrivedAt.Valid {
+			return &waypoints[i]
+		}
+	}
+	return nil
+}
+
+// 椅子が次の立ち寄り地点にいれば着いたことにする。着いた地点を返す
+func arriveRideWaypoint(ctx context.Context, tx *sqlx.Tx, waypoints []RideWaypoint, location ChairLocation) (*RideWaypoint, error) {
+	next := nextRideWaypoint(waypoints)
+	if next == nil || next.Latitude != location.Latitude || next.Longitude != location.Longitude {
+		return nil, nil
+	}
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE ride_waypoints SET arrived_at = ? WHERE ride_id = ? AND position = ? AND arrived_at IS NULL",
+		location.CreatedAt, next.RideID, next.Position,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if count == 0 {
+		return nil, errors.New("waypoint has already been arrived")
+	}
+	next.ArrivedAt.Time = location.CreatedAt
+	next.ArrivedAt.Valid = true
+	return next, nil
+}
+
+type rideWaypointResponse struct {
+	Position   int        `json:"position"`
+	Coordinate Coordinate `json:"coordinate"`
+	// PENDING か ARRIVED
+	Status    string `json:"status"`
+	ArrivedAt *int64 `json:"arrived_at,omitempty"`
+}
+
+// 立ち寄り地点が無ければ nil を返し、レスポンスからは省く
+func newRideWaypointsResponse(waypoints []RideWaypoint) []rideWaypointResponse {
+	if len(waypoints) == 0 {
+		return nil
+	}
+	res := make([]rideWaypointResponse, 0, len(waypoints))
+	for _, waypoint := range waypoints {
+		item := rideWaypointResponse{
+			Position:   waypoint.Position,
+			Coordinate: Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude},
+			Status:     rideWaypointStatusPending,
+		}
+		if waypoint.ArrivedAt.Valid {
+			arrivedAt := waypoint.ArrivedAt.Time.UnixMilli()
+			item.Status = rideWaypointStatusArrived
+			item.ArrivedAt = &arrivedAt
+		}
+		res = append(res, item)
+	}
+	return res
+}
+
+// 目的地までの残りの経路。current から未到着の立ち寄り地点を回って目的地まで
+func remainingRoute(current Coordinate, waypoints []RideWaypoint, destination Coordinate) int {
+	pending := []Coordinate{}
+	for _, waypoint := range waypoints {
+		if !waypoint.ArrivedAt.Valid {
+			pending = append(pending, Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude})
+		}
+	}
+	return routeDistance(current, pending, destination)
+}
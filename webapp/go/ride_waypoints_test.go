@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateWaypoints(t *testing.T) {
+	at := func(lat, lon int) Coordinate { return Coordinate{Latitude: lat, Longitude: lon} }
+	pickup := at(0, 0)
+	destination := at(10, 10)
+
+	tests := []struct {
+		name        string
+		waypoints   []Coordinate
+		destination Coordinate
+		want        error
+	}{
+		{name: "立ち寄り地点無し", waypoints: nil, destination: destination, want: nil},
+		{name: "立ち寄り地点無しなら乗車地と目的地の比較はしない", waypoints: nil, destination: pickup, want: nil},
+		{name: "異なる地点を回る", waypoints: []Coordinate{at(5, 0), at(5, 5)}, destination: destination, want: nil},
+		{name: "一度離れれば同じ地点に戻ってもよい", waypoints: []Coordinate{at(5, 0), at(0, 0)}, destination: destination, want: nil},
+		{name: "最初の立ち寄り地点が乗車地と同じ", waypoints: []Coordinate{pickup}, destination: destination, want: errSameAsPrevStop},
+		{name: "続けて同じ立ち寄り地点", waypoints: []Coordinate{at(5, 0), at(5, 0)}, destination: destination, want: errSameAsPrevStop},
+		{name: "最後の立ち寄り地点が目的地と同じ", waypoints: []Coordinate{at(5, 0), destination}, destination: destination, want: errSameAsPrevStop},
+		{name: "多すぎる", waypoints: []Coordinate{at(1, 0), at(2, 0), at(3, 0), at(4, 0), at(5, 0), at(6, 0)}, destination: destination, want: errTooManyWaypoints},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateWaypoints(newServiceArea(), pickup, tt.waypoints, tt.destination); !errors.Is(err, tt.want) {
+				t.Errorf("validateWaypoints() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
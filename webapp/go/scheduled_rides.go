@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ユーザーごとに同時に持てる予約の数
+const maxUpcomingScheduledRides = 5
+
+var errScheduledRideNotCancelable = errors.New("ride is not scheduled or already matching")
+
+type scheduledRideConfig struct {
+	// 乗車日時のこの時間前に配車待ちに入れる。これより近い日時は予約できない
+	Lead time.Duration
+	// どれだけ先まで予約できるか
+	MaxAhead time.Duration
+	// 配車待ちに入れる予約を探す間隔
+	Interval time.Duration
+}
+
+func newScheduledRideConfigFromEnv() scheduledRideConfig {
+	config := scheduledRideConfig{
+		Lead:     10 * time.Minute,
+		MaxAhead: 7 * 24 * time.Hour,
+		Interval: 10 * time.Second,
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_SCHEDULED_RIDE_LEAD_SEC")); err == nil && v > 0 {
+		config.Lead = time.Duration(v) * time.Second
+	}
+	return config
+}
+
+func (c scheduledRideConfig) validate(scheduledAt, now time.Time) error {
+	if scheduledAt.Before(now.Add(c.Lead)) {
+		return fmt.Errorf("scheduled_at must be at least %s ahead", c.Lead)
+	}
+	if scheduledAt.After(now.Add(c.MaxAhead)) {
+		return fmt.Errorf("scheduled_at must be within %s", c.MaxAhead)
+	}
+	return nil
+}
+
+// 乗車日時が近づいた予約を定期的に配車待ちに入れる
+func (h *apiHandler) startScheduledRideActivator(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(h.scheduledRides.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := h.activateScheduledRides(ctx, now); err != nil {
+					slog.Error("failed to activate scheduled rides", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func (h *apiHandler) activateScheduledRides(ctx context.Context, now time.Time) error {
+	rideIDs := []string{}
+	if err := h.db.SelectContext(
+		ctx,
+		&rideIDs,
+		`SELECT id FROM rides
+		 WHERE dormant = TRUE
+		   AND scheduled_at <= ?
+		   AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'CANCELED')
+		 ORDER BY scheduled_at`,
+		now.Add(h.scheduledRides.Lead),
+	); err != nil {
+		return err
+	}
+	// 1件失敗しても、後に続く予約は待たせない
+	for _, rideID := range rideIDs {
+		if err := h.activateScheduledRide(ctx, rideID); err != nil {
+			slog.Error("failed to activate scheduled ride", "ride_id", rideID, "error", err)
+		}
+	}
+	return nil
+}
+
+// 利用者が別のライドに乗っている間は、そのライドが終わるまで次の見回りに回す
+func (h *apiHandler) activateScheduledRide(ctx context.Context, rideID string) error {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		return err
+	}
+	if !ride.Dormant {
+		return nil
+	}
+	if canceled, err := isRideCanceled(ctx, tx, ride.ID); err != nil {
+		return err
+	} else if canceled {
+		return nil
+	}
+
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE user_id = ? AND dormant = FALSE", ride.UserID); err != nil {
+		return err
+	}
+	for _, r := range rides {
+		status, err := h.getLatestRideStatus(ctx, tx, r.ID)
+		if err != nil {
+			return err
+		}
+		if status != "COMPLETED" {
+			return nil
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE rides SET dormant = FALSE WHERE id = ?", ride.ID); err != nil {
+		return err
+	}
+	// 未通知の状態は古いものから送るので、SCHEDULED が残っていると椅子にも利用者にも MATCHING より先に届いてしまう。
+	// 配車待ちに入った時点で予約中であることを伝える意味はないので、通知済みにしておく
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE ride_statuses
+		 SET app_sent_at = IFNULL(app_sent_at, CURRENT_TIMESTAMP(6)), chair_sent_at = IFNULL(chair_sent_at, CURRENT_TIMESTAMP(6))
+		 WHERE ride_id = ? AND status = 'SCHEDULED'`,
+		ride.ID,
+	); err != nil {
+		return err
+	}
+	afterCommit, err := h.createRideStatus(ctx, tx, ride.ID, "MATCHING")
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return afterCommit(ctx)
+}
+
+// キャッシュを経由せず、ロック中のトランザクションで確認する
+func isRideCanceled(ctx context.Context, tx executableGet, rideID string) (bool, error) {
+	var canceled bool
+	if err := tx.GetContext(ctx, &canceled, "SELECT COUNT(*) > 0 FROM ride_statuses WHERE ride_id = ? AND status = 'CANCELED'", rideID); err != nil {
+		return false, err
+	}
+	return canceled, nil
+}
+
+type appGetScheduledRidesResponse struct {
+	Rides []appGetScheduledRidesResponseItem `json:"rides"`
+}
+
+type appGetScheduledRidesResponseItem struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Fare                  int        `json:"fare"`
+	ScheduledAt           int64      `json:"scheduled_at"`
+	CreatedAt             int64      `json:"created_at"`
+}
+
+// まだ配車待ちに入っていない予約を乗車日時の近い順に返す
+func (h *apiHandler) appGetScheduledRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	rides := []Ride{}
+	if err := h.db.SelectContext(
+		ctx,
+		&rides,
+		`SELECT * FROM rides
+		 WHERE user_id = ?
+		   AND dormant = TRUE
+		   AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'CANCELED')
+		 ORDER BY scheduled_at`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := []appGetScheduledRidesResponseItem{}
+	for _, ride := range rides {
+		items = append(items, appGetScheduledRidesResponseItem{
+			ID: ride.ID,
+			PickupCoordinate: Coordinate{
+				Latitude:  ride.PickupLatitude,
+				Longitude: ride.PickupLongitude,
+			},
+			DestinationCoordinate: Coordinate{
+				Latitude:  ride.DestinationLatitude,
+				Longitude: ride.DestinationLongitude,
+			},
+			Fare:        ride.Fare,
+			ScheduledAt: ride.ScheduledAt.Time.UnixMilli(),
+			CreatedAt:   ride.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetScheduledRidesResponse{Rides: items})
+}
+
+// 配車待ちに入る前の予約をキャンセルし、使ったクーポンを戻す
+func (h *apiHandler) appPostScheduledRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	tx, err := BeginMultiTx(h.db, h.db2)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, "db1", ride, "SELECT * FROM rides WHERE id = ? AND user_id = ? FOR UPDATE", rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ride.Dormant {
+		writeError(w, http.StatusConflict, errScheduledRideNotCancelable)
+		return
+	}
+	if canceled, err := isRideCanceled(ctx, tx.tx1, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if canceled {
+		writeError(w, http.StatusConflict, errScheduledRideNotCancelable)
+		return
+	}
+
+	afterCommit, err := h.createRideStatus(ctx, tx.tx1, ride.ID, "CANCELED")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "db2", "UPDATE coupons SET used_by = NULL WHERE used_by = ?", ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := afterCommit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
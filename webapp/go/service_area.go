@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// settings の service_area が無いときの最短乗車距離。乗車地と目的地が同じライドは受け付けない
+const defaultMinTripDistance = 1
+
+var (
+	errOutOfServiceArea = errors.New("coordinate is outside the service area")
+	errTripTooShort     = errors.New("distance between pickup and destination is too short")
+)
+
+// serviceAreaRegion は矩形か多角形のどちらか一方で営業エリアを表す
+type serviceAreaRegion struct {
+	Name      string                `json:"name"`
+	Rectangle *serviceAreaRectangle `json:"rectangle,omitempty"`
+	// 頂点を順に並べたもの。最後の頂点と最初の頂点は自動でつながる
+	Polygon []Coordinate `json:"polygon,omitempty"`
+}
+
+// 両端を含む
+type serviceAreaRectangle struct {
+	MinLatitude  int `json:"min_latitude"`
+	MaxLatitude  int `json:"max_latitude"`
+	MinLongitude int `json:"min_longitude"`
+	MaxLongitude int `json:"max_longitude"`
+}
+
+// settings の service_area に JSON で保存する設定。regions が空なら営業エリアの制限はしない
+type serviceAreaConfig struct {
+	Regions         []serviceAreaRegion `json:"regions"`
+	MinTripDistance int                 `json:"min_trip_distance"`
+}
+
+func (c *serviceAreaConfig) validate() error {
+	if c.MinTripDistance < 0 {
+		return errors.New("min_trip_distance must not be negative")
+	}
+	for _, region := range c.Regions {
+		if (region.Rectangle == nil) == (len(region.Polygon) == 0) {
+			return fmt.Errorf("region %q must have either rectangle or polygon", region.Name)
+		}
+		if region.Rectangle != nil && (region.Rectangle.MinLatitude > region.Rectangle.MaxLatitude || region.Rectangle.MinLongitude > region.Rectangle.MaxLongitude) {
+			return fmt.Errorf("region %q has an empty rectangle", region.Name)
+		}
+		if region.Rectangle == nil && len(region.Polygon) < 3 {
+			return fmt.Errorf("region %q must have at least 3 polygon vertices", region.Name)
+		}
+	}
+	return nil
+}
+
+func (r *serviceAreaRegion) contains(c Coordinate) bool {
+	if r.Rectangle != nil {
+		return r.Rectangle.MinLatitude <= c.Latitude && c.Latitude <= r.Rectangle.MaxLatitude &&
+			r.Rectangle.MinLongitude <= c.Longitude && c.Longitude <= r.Rectangle.MaxLongitude
+	}
+	return polygonContains(r.Polygon, c)
+}
+
+// 辺の上の点は内側として扱う
+func polygonContains(polygon []Coordinate, c Coordinate) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if onSegment(a, b, c) {
+			return true
+		}
+		if (a.Latitude > c.Latitude) != (b.Latitude > c.Latitude) {
+			// c を通る緯度の線と辺 ab の交点の経度
+			crossLongitude := float64(a.Longitude) + float64(c.Latitude-a.Latitude)*float64(b.Longitude-a.Longitude)/float64(b.Latitude-a.Latitude)
+			if float64(c.Longitude) < crossLongitude {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func onSegment(a, b, c Coordinate) bool {
+	cross := (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude) - (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude)
+	return cross == 0 &&
+		min(a.Latitude, b.Latitude) <= c.Latitude && c.Latitude <= max(a.Latitude, b.Latitude) &&
+		min(a.Longitude, b.Longitude) <= c.Longitude && c.Longitude <= max(a.Longitude, b.Longitude)
+}
+
+// serviceArea は営業エリアの設定と、エリア外から位置を送ってきた椅子を持つ
+type serviceArea struct {
+	mu     sync.RWMutex
+	config serviceAreaConfig
+	// エリア外の位置を最後に受け取った日時
+	outOfAreaChairs map[string]time.Time
+}
+
+func newServiceArea() *serviceArea {
+	return &serviceArea{
+		config:          serviceAreaConfig{MinTripDistance: defaultMinTripDistance},
+		outOfAreaChairs: map[string]time.Time{},
+	}
+}
+
+func (a *serviceArea) load(ctx context.Context, db *sqlx.DB) error {
+	config := serviceAreaConfig{MinTripDistance: defaultMinTripDistance}
+	var value string
+	if err := db.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'service_area'"); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	} else {
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			return fmt.Errorf("failed to parse service_area: %w", err)
+		}
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("invalid service_area: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	a.config = config
+	a.outOfAreaChairs = map[string]time.Time{}
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *serviceArea) contains(c Coordinate) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.config.Regions) == 0 {
+		return true
+	}
+	for _, region := range a.config.Regions {
+		if region.contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// ライドの乗車地・立ち寄り地点・目的地を検証する。最短乗車距離は立ち寄り地点を回った経路の距離で比べる
+func (a *serviceArea) validateTrip(pickup Coordinate, waypoints []Coordinate, destination Coordinate) error {
+	if !a.contains(pickup) || !a.contains(destination) {
+		return errOutOfServiceArea
+	}
+	if err := validateWaypoints(a, pickup, waypoints, destination); err != nil {
+		return err
+	}
+	a.mu.RLock()
+	minTripDistance := a.config.MinTripDistance
+	a.mu.RUnlock()
+	if routeDistance(pickup, waypoints, destination) < minTripDistance {
+		return errTripTooShort
+	}
+	return nil
+}
+
+// 椅子の最新の位置がエリア外かどうかを記録する
+func (a *serviceArea) recordChairLocation(chairID string, location ChairLocation) {
+	outside := !a.contains(Coordinate{Latitude: location.Latitude, Longitude: location.Longitude})
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if outside {
+		a.outOfAreaChairs[chairID] = location.CreatedAt
+	} else {
+		delete(a.outOfAreaChairs, chairID)
+	}
+}
+
+func (a *serviceArea) chairOutOfArea(chairID string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	_, ok := a.outOfAreaChairs[chairID]
+	return ok
+}
+
+// 起動時と初期化時に設定を読み込み、メモリ上の最新の位置からエリア外の椅子を数え直す
+func (h *apiHandler) initServiceArea(ctx context.Context) error {
+	if err := h.serviceArea.load(ctx, h.db); err != nil {
+		return err
+	}
+	for chairID, location := range h.chairLocations.snapshot() {
+		h.serviceArea.recordChairLocation(chairID, location)
+	}
+	return nil
+}
+
+type appGetServiceAreaResponse struct {
+	Restricted      bool                `json:"restricted"`
+	Regions         []serviceAreaRegion `json:"regions"`
+	MinTripDistance int                 `json:"min_trip_distance"`
+}
+
+// 営業エリアを返す。restricted が false ならどこでも配車できる
+func (h *apiHandler) appGetServiceArea(w http.ResponseWriter, r *http.Request) {
+	h.serviceArea.mu.RLock()
+	config := h.serviceArea.config
+	h.serviceArea.mu.RUnlock()
+
+	res := appGetServiceAreaResponse{
+		Restricted:      len(config.Regions) > 0,
+		Regions:         config.Regions,
+		MinTripDistance: config.MinTripDistance,
+	}
+	if res.Regions == nil {
+		res.Regions = []serviceAreaRegion{}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestOnSegment(t *testing.T) {
+	at := func(lat, lon int) Coordinate { return Coordinate{Latitude: lat, Longitude: lon} }
+	tests := []struct {
+		name string
+		a, b Coordinate
+		c    Coordinate
+		want bool
+	}{
+		{name: "端点", a: at(0, 0), b: at(10, 0), c: at(0, 0), want: true},
+		{name: "もう一方の端点", a: at(0, 0), b: at(10, 0), c: at(10, 0), want: true},
+		{name: "途中", a: at(0, 0), b: at(10, 0), c: at(5, 0), want: true},
+		{name: "斜めの辺の途中", a: at(0, 0), b: at(10, 10), c: at(3, 3), want: true},
+		{name: "延長線上", a: at(0, 0), b: at(10, 0), c: at(11, 0), want: false},
+		{name: "逆向きの延長線上", a: at(0, 0), b: at(10, 10), c: at(-1, -1), want: false},
+		{name: "線から外れている", a: at(0, 0), b: at(10, 10), c: at(3, 4), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := onSegment(tt.a, tt.b, tt.c); got != tt.want {
+				t.Errorf("onSegment(%v, %v, %v) = %v, want %v", tt.a, tt.b, tt.c, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolygonContains(t *testing.T) {
+	at := func(lat, lon int) Coordinate { return Coordinate{Latitude: lat, Longitude: lon} }
+	square := []Coordinate{at(0, 0), at(0, 10), at(10, 10), at(10, 0)}
+	// 経度 10〜20、緯度 0〜20 がへこんだ U 字
+	concave := []Coordinate{at(0, 0), at(30, 0), at(30, 30), at(0, 30), at(0, 20), at(20, 20), at(20, 10), at(0, 10)}
+	diamond := []Coordinate{at(0, 10), at(10, 20), at(20, 10), at(10, 0)}
+
+	tests := []struct {
+		name    string
+		polygon []Coordinate
+		c       Coordinate
+		want    bool
+	}{
+		{name: "正方形の内側", polygon: square, c: at(5, 5), want: true},
+		{name: "正方形の外側", polygon: square, c: at(15, 5), want: false},
+		{name: "正方形の辺の上", polygon: square, c: at(0, 5), want: true},
+		{name: "正方形の頂点", polygon: square, c: at(10, 10), want: true},
+		{name: "辺の延長線上の外側", polygon: square, c: at(0, 15), want: false},
+		{name: "U 字の左の腕", polygon: concave, c: at(5, 5), want: true},
+		{name: "U 字の右の腕", polygon: concave, c: at(5, 25), want: true},
+		{name: "U 字のへこみ", polygon: concave, c: at(5, 15), want: false},
+		{name: "U 字の底", polygon: concave, c: at(25, 15), want: true},
+		{name: "へこみの奥の辺の上", polygon: concave, c: at(20, 15), want: true},
+		{name: "へこみの角", polygon: concave, c: at(20, 20), want: true},
+		{name: "へこみの入り口", polygon: concave, c: at(0, 15), want: false},
+		{name: "頂点と同じ緯度の内側", polygon: diamond, c: at(10, 5), want: true},
+		{name: "頂点と同じ緯度の外側", polygon: diamond, c: at(10, 25), want: false},
+		{name: "頂点を通る緯度の外側の手前", polygon: diamond, c: at(0, 5), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := polygonContains(tt.polygon, tt.c); got != tt.want {
+				t.Errorf("polygonContains(%v) = %v, want %v", tt.c, got, tt.want)
+			}
+		})
+	}
+}
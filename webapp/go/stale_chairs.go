@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const ownerNotificationKindChairStale = "CHAIR_STALE"
+
+type staleChairConfig struct {
+	// この時間位置が送られてこなければ途絶えたとみなす
+	After time.Duration
+	// 見回りの間隔
+	Interval time.Duration
+}
+
+func newStaleChairConfigFromEnv() staleChairConfig {
+	config := staleChairConfig{
+		After:    10 * time.Minute,
+		Interval: 30 * time.Second,
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_STALE_CHAIR_AFTER_SEC")); err == nil && v > 0 {
+		config.After = time.Duration(v) * time.Second
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_STALE_CHAIR_SWEEP_INTERVAL_SEC")); err == nil && v > 0 {
+		config.Interval = time.Duration(v) * time.Second
+	}
+	return config
+}
+
+// 位置の送信が途絶えた椅子を定期的に探す。途絶えた椅子はメモリ上で外すだけで is_active は変えないので、
+// 椅子が位置の送信を再開すればそのまま戻ってくる
+func (h *apiHandler) startStaleChairSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(h.staleChair.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := h.sweepStaleChairs(ctx, now); err != nil {
+					slog.Error("failed to sweep stale chairs", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// 初期データの位置は古いので、グリッドを作り直した時点より前の位置はその時点に受け取ったものとして扱う
+func (h *apiHandler) sweepStaleChairs(ctx context.Context, now time.Time) error {
+	loadedAt := h.chairGrid.lastLoadedAt()
+	// 1台失敗しても、ほかの椅子の見回りは続ける。失敗した椅子は途絶えた扱いにしないので次の見回りでやり直す
+	for _, chairID := range h.chairGrid.reportingChairIDs() {
+		location, ok := h.chairLocations.get(chairID)
+		if !ok || now.Sub(maxTime(location.CreatedAt, loadedAt)) < h.staleChair.After {
+			continue
+		}
+		if err := h.handleStaleChair(ctx, chairID, location); err != nil {
+			slog.Error("failed to handle stale chair", "chair_id", chairID, "error", err)
+		}
+	}
+	return nil
+}
+
+// 途絶えた椅子のオーナーに通知し、まだ乗せていないライドが割り当てられていれば配車し直す。
+// 確定してから配車対象から外す
+func (h *apiHandler) handleStaleChair(ctx context.Context, chairID string, lastLocation ChairLocation) error {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 位置の記録と同じロックを取り、その間にライドの状態が進まないようにする
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return err
+	}
+	// ロックを待つ間に位置が届いていれば、途絶えていない
+	var latestAt time.Time
+	if err := tx.GetContext(ctx, &latestAt, "SELECT created_at FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1", chairID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	} else if latestAt.After(lastLocation.CreatedAt) {
+		return nil
+	}
+
+	message := fmt.Sprintf("椅子 %s から %s 以降位置が届いていないため、配車対象から外しました", chair.Name, lastLocation.CreatedAt.Format(time.DateTime))
+	afterCommits := []afterCommitFunc{}
+	var rideStatus *string
+	rides, err := chairCurrentRides(ctx, tx, chair.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	for _, ride := range rides {
+		// キャッシュはコミット後に消されるので、ロックを取った後の状態を DB から読む
+		var status string
+		if err := tx.GetContext(ctx, &status, "SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1", ride.ID); err != nil {
+			return err
+		}
+		// 乗車前なら別の椅子に回す。乗車後は途中で降ろせないのでそのままにする
+		if status == "MATCHING" || status == "ENROUTE" {
+			// 相乗りの相手として割り当てていたなら、相乗りも取り消す
+			if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL, pooled_with = NULL WHERE id = ?", ride.ID); err != nil {
+				return err
+			}
+			// 完了した相手のライドは updated_at を完了日時として売上に数えるので触らない
+			if _, err := tx.ExecContext(
+				ctx,
+				"UPDATE rides SET pooled_with = NULL, updated_at = updated_at WHERE pooled_with = ? AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'COMPLETED')",
+				ride.ID,
+			); err != nil {
+				return err
+			}
+			// 前の椅子に届いていない状態を新しい椅子に送らないよう、通知済みにしておく
+			if _, err := tx.ExecContext(ctx, "UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE ride_id = ? AND chair_sent_at IS NULL", ride.ID); err != nil {
+				return err
+			}
+			afterCommit, err := h.createRideStatus(ctx, tx, ride.ID, "MATCHING")
+			if err != nil {
+				return err
+			}
+			afterCommits = append(afterCommits, afterCommit)
+			message += fmt.Sprintf("。割り当て済みのライド %s は別の椅子に配車し直します", ride.ID)
+		} else if rideStatus == nil && status != "COMPLETED" {
+			rideStatus = &status
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO owner_notifications (id, owner_id, chair_id, kind, message) VALUES (?, ?, ?, ?, ?)",
+		ulid.Make().String(), chair.OwnerID, chair.ID, ownerNotificationKindChairStale, message,
+	); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, afterCommit := range afterCommits {
+		if err := afterCommit(ctx); err != nil {
+			return err
+		}
+	}
+	h.chairGrid.setStale(chair.ID)
+	// 乗車中のライドが残っていれば busy のままにする
+	if rideStatus == nil {
+		h.chairGrid.setBusy(chair.ID, false)
+	}
+	h.fleet.publish(fleetEvent{
+		OwnerID:    chair.OwnerID,
+		Chair:      *chair,
+		Coordinate: Coordinate{Latitude: lastLocation.Latitude, Longitude: lastLocation.Longitude},
+		RideStatus: rideStatus,
+		RecordedAt: lastLocation.CreatedAt,
+	})
+	return nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+type ownerGetNotificationsResponse struct {
+	Notifications []ownerGetNotificationsResponseNotification `json:"notifications"`
+}
+
+type ownerGetNotificationsResponseNotification struct {
+	ID        string `json:"id"`
+	ChairID   string `json:"chair_id"`
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// オーナーへの通知を新しい順に返す
+func (h *apiHandler) ownerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	notifications := []OwnerNotification{}
+	if err := h.db.SelectContext(ctx, &notifications, "SELECT * FROM owner_notifications WHERE owner_id = ? ORDER BY created_at DESC LIMIT 50", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetNotificationsResponse{Notifications: []ownerGetNotificationsResponseNotification{}}
+	for _, notification := range notifications {
+		res.Notifications = append(res.Notifications, ownerGetNotificationsResponseNotification{
+			ID:        notification.ID,
+			ChairID:   notification.ChairID,
+			Kind:      notification.Kind,
+			Message:   notification.Message,
+			CreatedAt: notification.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
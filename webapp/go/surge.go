@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+)
+
+// サージ倍率は%で扱う。100 が等倍
+const noSurgeRate = 100
+
+type surgeConfig struct {
+	// キルスイッチ。false なら常に等倍
+	Enabled bool
+	// 倍率の上限(%)
+	MaxRate int
+	// 需給を数えるグリッドの一辺の長さ
+	CellSize int
+}
+
+func newSurgeConfigFromEnv() surgeConfig {
+	config := surgeConfig{
+		Enabled:  os.Getenv("ISUCON_SURGE_ENABLED") == "1",
+		MaxRate:  200,
+		CellSize: 20,
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_SURGE_MAX_RATE")); err == nil && v >= noSurgeRate {
+		config.MaxRate = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_SURGE_CELL_SIZE")); err == nil && v > 0 {
+		config.CellSize = v
+	}
+	return config
+}
+
+// 座標が属するグリッドの範囲(両端を含む)
+func (c surgeConfig) cellBounds(latitude, longitude int) (minLat, maxLat, minLon, maxLon int) {
+	minLat = floorDiv(latitude, c.CellSize) * c.CellSize
+	minLon = floorDiv(longitude, c.CellSize) * c.CellSize
+	return minLat, minLat + c.CellSize - 1, minLon, minLon + c.CellSize - 1
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// 待ちライド数と空き椅子数からサージ倍率(%)を求める
+func surgeRateFor(waitingRides, freeChairs, maxRate int) int {
+	if waitingRides <= freeChairs {
+		return noSurgeRate
+	}
+	if freeChairs == 0 {
+		return maxRate
+	}
+	return min(waitingRides*noSurgeRate/freeChairs, maxRate)
+}
+
+// 配車位置を含むグリッド内の、椅子待ちのライド数と空いているアクティブな椅子の数からサージ倍率を求める
+func (h *apiHandler) calculateSurgeRate(ctx context.Context, tx executableGet, latitude, longitude int) (int, error) {
+	if !h.surge.Enabled {
+		return noSurgeRate, nil
+	}
+
+	minLat, maxLat, minLon, maxLon := h.surge.cellBounds(latitude, longitude)
+
+	var waitingRides int
+	if err := tx.GetContext(
+		ctx,
+		&waitingRides,
+		`SELECT COUNT(*) FROM rides
+		 WHERE chair_id IS NULL
+		   AND dormant = FALSE
+		   AND pickup_latitude BETWEEN ? AND ?
+		   AND pickup_longitude BETWEEN ? AND ?`,
+		minLat, maxLat, minLon, maxLon,
+	); err != nil {
+		return 0, err
+	}
+	if waitingRides == 0 {
+		return noSurgeRate, nil
+	}
+
+	// 空いている椅子はメモリ上のグリッドから数える。途絶えた椅子・引退した椅子・乗車中の椅子は含まれない
+	freeChairs := h.chairGrid.countFree(
+		Coordinate{Latitude: minLat, Longitude: minLon},
+		Coordinate{Latitude: maxLat, Longitude: maxLon},
+	)
+
+	return surgeRateFor(waitingRides, freeChairs, h.surge.MaxRate), nil
+}
+
+// レスポンス用の倍率表記
+func surgeMultiplier(surgeRate int) float64 {
+	return float64(surgeRate) / noSurgeRate
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 位置履歴から椅子ごとの総移動距離を数え直すクエリ。位置を送ったことのない椅子は含まれない
+const recomputeTotalDistanceQuery = `
+SELECT chair_id,
+       SUM(IFNULL(distance, 0)) AS total_distance,
+       MAX(created_at)          AS total_distance_updated_at
+FROM (SELECT chair_id,
+             created_at,
+             ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
+             ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
+      FROM chair_locations) tmp
+GROUP BY chair_id`
+
+type chairTotalDistance struct {
+	ChairID                string       `db:"chair_id"`
+	TotalDistance          int          `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+}
+
+// 新しく記録した位置の移動距離を chairs.total_distance に足し込む。
+// prev はそれより前の最新の位置(無ければ nil)。呼び出し側で椅子の行をロックしておくこと
+func addChairTotalDistance(ctx context.Context, tx *sqlx.Tx, chairID string, prev *ChairLocation, locations []ChairLocation) error {
+	distance := 0
+	for _, location := range locations {
+		if prev != nil {
+			distance += calculateDistance(prev.Latitude, prev.Longitude, location.Latitude, location.Longitude)
+		}
+		prev = &location
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		"UPDATE chairs SET total_distance = total_distance + ?, total_distance_updated_at = ? WHERE id = ?",
+		distance, locations[len(locations)-1].CreatedAt, chairID,
+	)
+	return err
+}
+
+// サブコマンドを実行して終了コードを返す
+func runCommand(name string) int {
+	ctx := context.Background()
+	var err error
+	switch name {
+	case "backfill-total-distance":
+		db, _ := connectDBs()
+		err = backfillTotalDistance(ctx, db)
+	case "check-total-distance":
+		db, _ := connectDBs()
+		var mismatches int
+		mismatches, err = checkTotalDistance(ctx, db)
+		if err == nil && mismatches > 0 {
+			fmt.Fprintf(os.Stderr, "%d chairs have inconsistent total_distance\n", mismatches)
+			return 1
+		}
+	case "backfill-ride-coupons":
+		db, db2 := connectDBs()
+		var updated int
+		updated, err = backfillRideCoupons(ctx, db, db2)
+		if err == nil {
+			fmt.Printf("backfilled coupons of %d rides\n", updated)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+		fmt.Fprintln(os.Stderr, "commands: backfill-total-distance, check-total-distance, backfill-ride-coupons")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// 全椅子の総移動距離を位置履歴から計算し直して上書きする
+func backfillTotalDistance(ctx context.Context, db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET total_distance = 0, total_distance_updated_at = NULL"); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `
+		UPDATE chairs JOIN (`+recomputeTotalDistanceQuery+`) distance_table ON distance_table.chair_id = chairs.id
+		SET chairs.total_distance = distance_table.total_distance,
+		    chairs.total_distance_updated_at = distance_table.total_distance_updated_at`)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	updated, _ := result.RowsAffected()
+	fmt.Printf("backfilled total_distance of %d chairs\n", updated)
+	return nil
+}
+
+// 保存されている総移動距離と位置履歴から計算した値を比べ、食い違う椅子を出力してその数を返す
+func checkTotalDistance(ctx context.Context, db *sqlx.DB) (int, error) {
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs"); err != nil {
+		return 0, err
+	}
+	expected := []chairTotalDistance{}
+	if err := db.SelectContext(ctx, &expected, recomputeTotalDistanceQuery); err != nil {
+		return 0, err
+	}
+	expectedByChairID := make(map[string]chairTotalDistance, len(expected))
+	for _, e := range expected {
+		expectedByChairID[e.ChairID] = e
+	}
+
+	mismatches := 0
+	for _, chair := range chairs {
+		e := expectedByChairID[chair.ID]
+		if chair.TotalDistance == e.TotalDistance && sameNullTime(chair.TotalDistanceUpdatedAt, e.TotalDistanceUpdatedAt) {
+			continue
+		}
+		mismatches++
+		fmt.Printf("%s: stored=%d (%s) expected=%d (%s)\n",
+			chair.ID,
+			chair.TotalDistance, formatNullTime(chair.TotalDistanceUpdatedAt),
+			e.TotalDistance, formatNullTime(e.TotalDistanceUpdatedAt),
+		)
+	}
+	fmt.Printf("checked %d chairs, %d mismatches\n", len(chairs), mismatches)
+	return mismatches, nil
+}
+
+func sameNullTime(a, b sql.NullTime) bool {
+	if a.Valid != b.Valid {
+		return false
+	}
+	return !a.Valid || a.Time.Equal(b.Time)
+}
+
+func formatNullTime(t sql.NullTime) string {
+	if !t.Valid {
+		return "NULL"
+	}
+	return t.Time.Format(time.RFC3339Nano)
+}
@@ -15,8 +15,10 @@ CREATE TABLE settings
 DROP TABLE IF EXISTS chair_models;
 CREATE TABLE chair_models
 (
-  name  VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
-  speed INTEGER     NOT NULL COMMENT '移動速度',
+  name              VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
+  speed             INTEGER     NOT NULL COMMENT '移動速度',
+  initial_fare      INTEGER     NOT NULL DEFAULT 500 COMMENT '初乗り運賃',
+  fare_per_distance INTEGER     NOT NULL DEFAULT 100 COMMENT '距離あたりの運賃',
   PRIMARY KEY (name)
 )
   COMMENT = '椅子モデルテーブル';
@@ -99,7 +101,7 @@ CREATE TABLE ride_statuses
 (
   id              VARCHAR(26)                                                                NOT NULL,
   ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'SCHEDULED', 'CANCELED') NOT NULL COMMENT '状態',
   created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
   app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
   chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
@@ -107,6 +109,18 @@ CREATE TABLE ride_statuses
 )
   COMMENT = 'ライドステータスの変更履歴テーブル';
 
+DROP TABLE IF EXISTS ride_waypoints;
+CREATE TABLE ride_waypoints
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  position   INTEGER     NOT NULL COMMENT '立ち寄る順番(1始まり)',
+  latitude   INTEGER     NOT NULL COMMENT '経度',
+  longitude  INTEGER     NOT NULL COMMENT '緯度',
+  arrived_at DATETIME(6) NULL     COMMENT '椅子が到着した日時',
+  PRIMARY KEY (ride_id, position)
+)
+  COMMENT = 'ライドの立ち寄り地点テーブル';
+
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
 (
@@ -123,6 +137,20 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS chair_register_tokens;
+CREATE TABLE chair_register_tokens
+(
+  token             VARCHAR(255) NOT NULL COMMENT '椅子登録トークン',
+  owner_id          VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  model             TEXT         NULL     COMMENT '登録できる椅子のモデル(NULLなら制限なし)',
+  max_chairs        INTEGER      NULL     COMMENT '登録できる椅子の台数(NULLなら制限なし)',
+  registered_chairs INTEGER      NOT NULL DEFAULT 0 COMMENT 'このトークンで登録された椅子の台数',
+  expires_at        DATETIME(6)  NULL     COMMENT '有効期限(NULLなら無期限)',
+  created_at        DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  PRIMARY KEY (token)
+)
+  COMMENT = 'オーナーが追加で発行する制限付きの椅子登録トークンテーブル';
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
@@ -134,3 +162,49 @@ CREATE TABLE coupons
   PRIMARY KEY (user_id, code)
 )
   COMMENT 'クーポンテーブル';
+
+DROP TABLE IF EXISTS payout_statements;
+CREATE TABLE payout_statements
+(
+  id              VARCHAR(26)            NOT NULL COMMENT '支払い明細ID',
+  owner_id        VARCHAR(26)            NOT NULL COMMENT 'オーナーID',
+  period_since    DATETIME(6)            NOT NULL COMMENT '対象期間の開始(この日時は含まない)',
+  period_until    DATETIME(6)            NOT NULL COMMENT '対象期間の終了(この日時を含む)',
+  commission_rate INTEGER                NOT NULL COMMENT '明細作成時の手数料率(%)',
+  rides           INTEGER                NOT NULL COMMENT '対象ライド数',
+  gross           INTEGER                NOT NULL COMMENT '売上合計',
+  commission      INTEGER                NOT NULL COMMENT '手数料合計',
+  net             INTEGER                NOT NULL COMMENT 'オーナーへの支払額',
+  status          ENUM ('UNPAID', 'PAID') NOT NULL DEFAULT 'UNPAID' COMMENT '支払い状況',
+  paid_at         DATETIME(6)            NULL COMMENT '支払い済みにした日時',
+  created_at      DATETIME(6)            NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  PRIMARY KEY (id),
+  UNIQUE (owner_id, period_since)
+)
+  COMMENT = 'オーナーへの支払い明細テーブル';
+
+DROP TABLE IF EXISTS payout_statement_chairs;
+CREATE TABLE payout_statement_chairs
+(
+  statement_id VARCHAR(26) NOT NULL COMMENT '支払い明細ID',
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  rides        INTEGER     NOT NULL COMMENT '対象ライド数',
+  gross        INTEGER     NOT NULL COMMENT '売上合計',
+  commission   INTEGER     NOT NULL COMMENT '手数料合計',
+  net          INTEGER     NOT NULL COMMENT '椅子ごとの純収益',
+  PRIMARY KEY (statement_id, chair_id)
+)
+  COMMENT = '支払い明細の椅子ごとの内訳テーブル';
+
+DROP TABLE IF EXISTS owner_notifications;
+CREATE TABLE owner_notifications
+(
+  id         VARCHAR(26)  NOT NULL COMMENT '通知ID',
+  owner_id   VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  chair_id   VARCHAR(26)  NOT NULL COMMENT '対象の椅子ID',
+  kind       VARCHAR(30)  NOT NULL COMMENT '通知の種類',
+  message    TEXT         NOT NULL COMMENT '通知内容',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '通知日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'オーナーへの通知テーブル';
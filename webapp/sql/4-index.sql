@@ -5,3 +5,5 @@ ALTER TABLE `chairs` ADD INDEX `idx_chairs_owner_id` (`owner_id`);
 ALTER TABLE `rides` ADD INDEX `idx_rides_chair_id_updated_at` (`chair_id`, `updated_at` DESC);
 ALTER TABLE `rides` ADD INDEX `idx_rides_user_id_created_at` (`user_id`, `created_at` DESC);
 ALTER TABLE `coupons` ADD INDEX `idx_coupons_used_by` (`used_by`);
+ALTER TABLE `chair_register_tokens` ADD INDEX `idx_chair_register_tokens_owner_id` (`owner_id`);
+ALTER TABLE `owner_notifications` ADD INDEX `idx_owner_notifications_owner_id_created_at` (`owner_id`, `created_at` DESC);
@@ -0,0 +1,65 @@
+SET CHARACTER_SET_CLIENT = utf8mb4;
+SET CHARACTER_SET_CONNECTION = utf8mb4;
+
+USE isuride;
+
+-- 初期データは列名なしのINSERTなので、既存テーブルへの列追加はデータ投入後にここで行う
+ALTER TABLE rides
+  ADD COLUMN surge_rate  INTEGER      NOT NULL DEFAULT 100 COMMENT 'ライド作成時に確定したサージ倍率(%)',
+  ADD COLUMN fare        INTEGER      NULL COMMENT 'ライド作成時に確定した請求額(割引後)',
+  ADD COLUMN discount    INTEGER      NOT NULL DEFAULT 0 COMMENT '実際に適用されたクーポン割引額',
+  ADD COLUMN coupon_code VARCHAR(255) NULL COMMENT '適用されたクーポンコード';
+
+-- 既存のライドの運賃を、これまでと同じ計算(初乗り500 + 距離あたり100)で埋める。
+-- クーポンは別の DB にあるので、割引は初期化時に backfillRideCoupons で反映する。
+-- updated_at は完了日時として売上の集計に使うので変えない
+UPDATE rides
+SET fare = 500
+  + 100 * (ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude)),
+    updated_at = updated_at;
+
+ALTER TABLE rides
+  MODIFY COLUMN fare INTEGER NOT NULL COMMENT 'ライド作成時に確定した請求額(割引後)';
+
+ALTER TABLE chairs
+  ADD COLUMN retired_at DATETIME(6) NULL COMMENT 'オーナーが引退させた日時';
+
+ALTER TABLE chairs
+  ADD COLUMN total_distance            INTEGER     NOT NULL DEFAULT 0 COMMENT 'これまでの総移動距離',
+  ADD COLUMN total_distance_updated_at DATETIME(6) NULL COMMENT '総移動距離の最終更新日時(最後に位置を受け取った日時)';
+
+-- 既存の位置履歴から総移動距離を埋める。backfill-total-distance サブコマンドと同じ計算
+UPDATE chairs
+  JOIN (SELECT chair_id,
+               SUM(IFNULL(distance, 0)) AS total_distance,
+               MAX(created_at)          AS total_distance_updated_at
+        FROM (SELECT chair_id,
+                     created_at,
+                     ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
+                     ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
+              FROM chair_locations) tmp
+        GROUP BY chair_id) distance_table ON distance_table.chair_id = chairs.id
+SET chairs.total_distance            = distance_table.total_distance,
+    chairs.total_distance_updated_at = distance_table.total_distance_updated_at;
+
+ALTER TABLE rides
+  ADD COLUMN scheduled_at DATETIME(6) NULL COMMENT '予約された乗車日時',
+  ADD COLUMN dormant      BOOLEAN     NOT NULL DEFAULT FALSE COMMENT '予約中でまだ配車待ちに入っていないか',
+  ADD INDEX idx_rides_dormant_scheduled_at (dormant, scheduled_at);
+
+ALTER TABLE rides
+  ADD COLUMN pooled        BOOLEAN     NOT NULL DEFAULT FALSE COMMENT '相乗りを選んだか',
+  ADD COLUMN pool_discount INTEGER     NOT NULL DEFAULT 0 COMMENT '相乗りを選んだことによる割引額',
+  ADD COLUMN pooled_with   VARCHAR(26) NULL COMMENT '同じ椅子に相乗りしている相手のライドID';
+
+-- 既存のライドはすべてデフォルトのレートで計算されている
+ALTER TABLE rides
+  ADD COLUMN initial_fare      INTEGER NOT NULL DEFAULT 500 COMMENT '運賃の計算に使った初乗り運賃',
+  ADD COLUMN fare_per_distance INTEGER NOT NULL DEFAULT 100 COMMENT '運賃の計算に使った距離あたりの運賃';
+
+ALTER TABLE chairs
+  ADD COLUMN deactivated_by_owner_at DATETIME(6) NULL COMMENT 'オーナーが受付停止にした日時。解除されるまで椅子からは再開できない';
+
+-- 見積もりの quote_id で作ったライドは、椅子が決まっても見積もった運賃のまま請求する
+ALTER TABLE rides
+  ADD COLUMN price_locked BOOLEAN NOT NULL DEFAULT FALSE COMMENT '見積もりで運賃が確定しているか';